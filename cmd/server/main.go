@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -11,6 +14,7 @@ import (
 	"github.com/toof-jp/shisha-log-backend/internal/api"
 	"github.com/toof-jp/shisha-log-backend/internal/auth"
 	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
 	"github.com/toof-jp/shisha-log-backend/internal/repository"
 	"github.com/toof-jp/shisha-log-backend/internal/service"
 )
@@ -41,35 +45,105 @@ func main() {
 	}
 
 	// Initialize services
-	jwtService := service.NewJWTService(cfg)
-	passwordService := service.NewPasswordService()
+	jwtService, err := service.NewJWTService(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize JWT service:", err)
+	}
+	passwordService := service.NewPasswordService(cfg)
+	passkeyService, err := service.NewPasskeyService(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize passkey service:", err)
+	}
+	totpService, err := service.NewTOTPService(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize TOTP service:", err)
+	}
+
+	// Messages are only written to the log unless SMTP delivery is configured
+	var notifier service.Notifier = service.NewLogNotifier()
+	if cfg.Notifier == "smtp" {
+		smtpNotifier, err := service.NewSMTPNotifier(cfg)
+		if err != nil {
+			log.Fatal("Failed to initialize SMTP notifier:", err)
+		}
+		notifier = smtpNotifier
+	}
+	notificationService, err := service.NewNotificationService(cfg, notifier)
+	if err != nil {
+		log.Fatal("Failed to initialize notification service:", err)
+	}
 
 	// Initialize repositories
 	userRepo := repository.NewUserRepository(db)
+	passkeyRepo := repository.NewPasskeyRepository(db)
+	refreshTokenRepo := repository.NewRefreshTokenRepository(db)
+	mfaRepo := repository.NewMFARepository(db)
+	deviceRepo := repository.NewDeviceRepository(db)
+	oidcRepo := repository.NewOIDCRepository(db)
+	patRepo := repository.NewPersonalAccessTokenRepository(db)
+	auditRepo := repository.NewAuditRepository(db)
+	maintenanceRepo := repository.NewMaintenanceRepository(db)
+
+	// Revoked access tokens are tracked in memory unless the store is shared via Postgres
+	var revocationStore service.RevocationStore = service.NewMemoryRevocationStore()
+	if cfg.RevocationStore == "postgres" {
+		revocationStore = repository.NewRevocationRepository(db)
+	}
+	// Login attempt counters are kept in memory unless shared via Postgres
+	var attemptStore service.AttemptStore = service.NewMemoryAttemptStore()
+	if cfg.AttemptStore == "postgres" {
+		attemptStore = repository.NewAttemptRepository(db)
+	}
+	bruteForceGuard := service.NewBruteForceGuard(cfg, attemptStore)
+	authRateLimiter := auth.NewRateLimiter(attemptStore, "auth", cfg.AuthRateLimit, time.Minute)
+
+	tokenService := service.NewTokenService(cfg, jwtService, userRepo, refreshTokenRepo, deviceRepo, patRepo, revocationStore)
 	profileRepo := repository.NewProfileRepository(supabaseClient)
-	sessionRepo := repository.NewSessionRepository(supabaseClient)
+	sessionRepo := repository.NewSessionRepository(db)
+	accountService := service.NewAccountService(cfg, userRepo, profileRepo, sessionRepo, tokenService)
+	patService := service.NewPersonalAccessTokenService(patRepo)
+	auditRecorder := service.NewAuditRecorder(auditRepo)
+	userIDService := service.NewUserIDService(cfg, userRepo)
+	emailService := service.NewEmailService(userRepo, notificationService)
+	sessionTimerService := service.NewSessionTimerService(cfg, sessionRepo)
+	adminService := service.NewAdminService(userRepo, profileRepo, sessionRepo, tokenService, notificationService)
+	oidcService := service.NewOIDCService(cfg, &http.Client{Timeout: 10 * time.Second}, oidcRepo, userRepo)
 
 	// Initialize handlers
-	authHandler := api.NewAuthHandler(userRepo, passwordService, jwtService)
+	authHandler := api.NewAuthHandler(userRepo, mfaRepo, passwordService, userIDService, tokenService, bruteForceGuard, notificationService, emailService, auditRecorder)
+	emailHandler := api.NewEmailHandler(userRepo, passwordService, emailService, bruteForceGuard, auditRecorder)
+	accountHandler := api.NewAccountHandler(userRepo, passwordService, accountService, userIDService, bruteForceGuard, auditRecorder)
+	deviceHandler := api.NewDeviceHandler(tokenService)
+	oidcHandler := api.NewOIDCHandler(oidcService, mfaRepo, tokenService, auditRecorder)
+	patHandler := api.NewPersonalAccessTokenHandler(patService)
+	auditHandler := api.NewAuditHandler(auditRecorder)
+	adminHandler := api.NewAdminHandler(adminService, auditRecorder)
+	mfaHandler := api.NewMFAHandler(userRepo, mfaRepo, totpService, passwordService, tokenService, bruteForceGuard, auditRecorder)
+	jwksHandler := api.NewJWKSHandler(jwtService)
+	passkeyHandler := api.NewPasskeyHandler(userRepo, passkeyRepo, passkeyService, tokenService, bruteForceGuard, auditRecorder)
 	profileHandler := api.NewProfileHandler(profileRepo)
-	sessionHandler := api.NewSessionHandler(sessionRepo)
+	sessionHandler := api.NewSessionHandler(sessionRepo, sessionTimerService)
 
 	// Initialize auth middleware
-	authMiddleware := auth.NewAuthMiddleware(jwtService)
+	authMiddleware := auth.NewAuthMiddleware(jwtService, revocationStore, userRepo, service.NewDeviceTracker(deviceRepo), patService)
 
 	// Create Echo instance
 	e := echo.New()
 
+	// Trust X-Forwarded-For only from the reverse proxy so client IPs can't be spoofed
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
+
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
 
 	// Configure CORS
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: cfg.AllowedOrigins,
 		AllowMethods: []string{echo.GET, echo.HEAD, echo.PUT, echo.PATCH, echo.POST, echo.DELETE},
 		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		// Social login binds its state to the browser with a cookie
+		AllowCredentials: true,
 	}))
 
 	// Health check
@@ -77,39 +151,109 @@ func main() {
 		return c.JSON(200, map[string]string{"status": "ok"})
 	})
 
+	// Public keys for verifying access tokens
+	e.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
 	// API routes
 	apiGroup := e.Group("/api/v1")
 
 	// Auth routes (public)
 	authGroup := apiGroup.Group("/auth")
-	authGroup.POST("/register", authHandler.Register)
-	authGroup.POST("/login", authHandler.Login)
-	authGroup.POST("/request-password-reset", authHandler.RequestPasswordReset)
-	authGroup.POST("/reset-password", authHandler.ResetPassword)
+	authGroup.POST("/register", authHandler.Register, authRateLimiter.Limit)
+	authGroup.POST("/login", authHandler.Login, authRateLimiter.Limit)
+	authGroup.POST("/login/mfa", mfaHandler.VerifyLogin, authRateLimiter.Limit)
+	authGroup.POST("/refresh", authHandler.Refresh, authRateLimiter.Limit)
+	authGroup.POST("/request-password-reset", authHandler.RequestPasswordReset, authRateLimiter.Limit)
+	authGroup.POST("/reset-password", authHandler.ResetPassword, authRateLimiter.Limit)
+	authGroup.POST("/verify-email", emailHandler.VerifyEmail, authRateLimiter.Limit)
+	authGroup.POST("/passkey/login/begin", passkeyHandler.BeginLogin, authRateLimiter.Limit)
+	authGroup.POST("/passkey/login/finish", passkeyHandler.FinishLogin, authRateLimiter.Limit)
+	authGroup.GET("/oidc/providers", oidcHandler.ListProviders)
+	authGroup.GET("/oidc/:provider/authorize", oidcHandler.Authorize, authRateLimiter.Limit)
+	authGroup.POST("/oidc/:provider/callback", oidcHandler.Callback, authRateLimiter.Limit)
+	authGroup.GET("/user-id-availability", accountHandler.CheckUserIDAvailability, authRateLimiter.Limit)
 
-	// Protected auth routes
+	// Protected auth routes (personal access tokens can't manage the account)
 	protectedAuth := authGroup.Group("")
-	protectedAuth.Use(authMiddleware.Authenticate)
+	protectedAuth.Use(authMiddleware.Authenticate, auth.RequirePermission(models.PermissionAccount))
 	protectedAuth.POST("/change-password", authHandler.ChangePassword)
+	protectedAuth.POST("/logout", authHandler.Logout)
+	protectedAuth.POST("/logout-all", authHandler.LogoutAll)
+	protectedAuth.GET("/devices", deviceHandler.ListDevices)
+	protectedAuth.DELETE("/devices/:id", deviceHandler.RevokeDevice)
+	protectedAuth.PUT("/email", emailHandler.SetEmail)
+	protectedAuth.POST("/email/resend", emailHandler.ResendVerification)
+	protectedAuth.POST("/passkey/register/begin", passkeyHandler.BeginRegistration)
+	protectedAuth.POST("/passkey/register/finish", passkeyHandler.FinishRegistration)
+	protectedAuth.GET("/passkey/credentials", passkeyHandler.ListCredentials)
+	protectedAuth.PATCH("/passkey/credentials/:id", passkeyHandler.RenameCredential)
+	protectedAuth.DELETE("/passkey/credentials/:id", passkeyHandler.DeleteCredential)
+	protectedAuth.POST("/oidc/:provider/link", oidcHandler.Link)
+	protectedAuth.GET("/oidc/identities", oidcHandler.ListIdentities)
+	protectedAuth.DELETE("/oidc/identities/:id", oidcHandler.UnlinkIdentity)
+	protectedAuth.GET("/tokens", patHandler.ListTokens)
+	protectedAuth.POST("/tokens", patHandler.CreateToken)
+	protectedAuth.DELETE("/tokens/:id", patHandler.RevokeToken)
+	protectedAuth.GET("/mfa", mfaHandler.GetStatus)
+	protectedAuth.POST("/mfa/totp/enroll", mfaHandler.EnrollTOTP)
+	protectedAuth.POST("/mfa/totp/confirm", mfaHandler.ConfirmTOTP)
+	protectedAuth.POST("/mfa/totp/disable", mfaHandler.DisableTOTP)
+	protectedAuth.POST("/mfa/recovery-codes", mfaHandler.RegenerateRecoveryCodes)
 
-	// Protected routes
+	// Protected routes, each declaring the permission it needs
 	protected := apiGroup.Group("")
 	protected.Use(authMiddleware.Authenticate)
 
 	// User routes
-	protected.GET("/users/me", authHandler.GetCurrentUser)
+	protected.GET("/users/me", authHandler.GetCurrentUser, auth.RequirePermission(models.PermissionProfileRead))
+	protected.PATCH("/users/me", accountHandler.UpdateAccount, auth.RequirePermission(models.PermissionAccount))
+	protected.DELETE("/users/me", accountHandler.DeleteAccount, auth.RequirePermission(models.PermissionAccount))
+	protected.POST("/users/me/cancel-deletion", accountHandler.CancelDeletion, auth.RequirePermission(models.PermissionAccount))
+	protected.GET("/users/me/security-events", auditHandler.ListSecurityEvents, auth.RequirePermission(models.PermissionAccount))
 
 	// Profile routes
-	protected.GET("/profile", profileHandler.GetProfile)
-	protected.POST("/profile", profileHandler.CreateProfile)
-	protected.PUT("/profile", profileHandler.UpdateProfile)
-
-	// Session routes
-	protected.POST("/sessions", sessionHandler.CreateSession)
-	protected.GET("/sessions", sessionHandler.GetUserSessions)
-	protected.GET("/sessions/:id", sessionHandler.GetSession)
-	protected.PUT("/sessions/:id", sessionHandler.UpdateSession)
-	protected.DELETE("/sessions/:id", sessionHandler.DeleteSession)
+	protected.GET("/profile", profileHandler.GetProfile, auth.RequirePermission(models.PermissionProfileRead))
+	protected.POST("/profile", profileHandler.CreateProfile, auth.RequirePermission(models.PermissionProfileWrite))
+	protected.PUT("/profile", profileHandler.UpdateProfile, auth.RequirePermission(models.PermissionProfileWrite))
+
+	// Session routes. Moderators can also read and change other users' sessions,
+	// which the handlers check with auth.CanAccess.
+	protected.POST("/sessions", sessionHandler.CreateSession, auth.RequirePermission(models.PermissionSessionsWrite))
+	protected.GET("/sessions", sessionHandler.GetUserSessions, auth.RequirePermission(models.PermissionSessionsRead))
+	protected.GET("/sessions/active", sessionHandler.GetActiveSession, auth.RequirePermission(models.PermissionSessionsRead))
+	protected.GET("/sessions/stats/flavors", sessionHandler.GetFlavorStats, auth.RequirePermission(models.PermissionSessionsRead))
+	protected.GET("/sessions/stats/mixes", sessionHandler.GetMixStats, auth.RequirePermission(models.PermissionSessionsRead))
+	protected.GET("/sessions/:id", sessionHandler.GetSession, auth.RequirePermission(models.PermissionSessionsRead))
+	protected.PUT("/sessions/:id", sessionHandler.UpdateSession, auth.RequirePermission(models.PermissionSessionsWrite))
+	protected.DELETE("/sessions/:id", sessionHandler.DeleteSession, auth.RequirePermission(models.PermissionSessionsWrite))
+	protected.POST("/sessions/:id/start", sessionHandler.StartSession, auth.RequirePermission(models.PermissionSessionsWrite))
+	protected.POST("/sessions/:id/stop", sessionHandler.StopSession, auth.RequirePermission(models.PermissionSessionsWrite))
+	protected.POST("/sessions/:id/flavors", sessionHandler.AddFlavor, auth.RequirePermission(models.PermissionSessionsWrite))
+	protected.PATCH("/sessions/:id/flavors/:flavorId", sessionHandler.UpdateFlavor, auth.RequirePermission(models.PermissionSessionsWrite))
+	protected.DELETE("/sessions/:id/flavors/:flavorId", sessionHandler.DeleteFlavor, auth.RequirePermission(models.PermissionSessionsWrite))
+
+	// Admin routes (moderators and admins)
+	adminGroup := apiGroup.Group("/admin")
+	adminGroup.Use(authMiddleware.Authenticate, auth.RequireRole(models.RoleModerator, models.RoleAdmin))
+	adminGroup.GET("/audit-events", auditHandler.ListEvents, auth.RequirePermission(models.PermissionAuditRead))
+	adminGroup.GET("/users", adminHandler.ListUsers, auth.RequirePermission(models.PermissionUsersRead))
+	adminGroup.GET("/users/:id", adminHandler.GetUser, auth.RequirePermission(models.PermissionUsersRead))
+	adminGroup.POST("/users/:id/suspend", adminHandler.SuspendUser, auth.RequirePermission(models.PermissionUsersManage))
+	adminGroup.POST("/users/:id/unsuspend", adminHandler.UnsuspendUser, auth.RequirePermission(models.PermissionUsersManage))
+	adminGroup.POST("/users/:id/force-password-reset", adminHandler.ForcePasswordReset, auth.RequirePermission(models.PermissionUsersManage))
+	adminGroup.POST("/users/:id/revoke-tokens", adminHandler.RevokeTokens, auth.RequirePermission(models.PermissionUsersManage))
+
+	// Purge expired tokens in the background
+	cleanupInterval := service.ParseDurationSetting(cfg.TokenCleanupInterval, time.Hour)
+	go service.RunPeriodically(context.Background(), "token cleanup", cleanupInterval, maintenanceRepo.CleanupExpiredTokens)
+
+	// Purge accounts whose deletion grace period has ended, retrying failed purges
+	purgeInterval := service.ParseDurationSetting(cfg.AccountPurgeInterval, 15*time.Minute)
+	go service.RunPeriodically(context.Background(), "account purge", purgeInterval, accountService.PurgeDue)
+
+	// Stop live sessions that were left running
+	autoStopInterval := service.ParseDurationSetting(cfg.SessionAutoStopInterval, 5*time.Minute)
+	go service.RunPeriodically(context.Background(), "session auto-stop", autoStopInterval, sessionTimerService.StopOverdue)
 
 	// Start server
 	log.Printf("Server starting on port %s", cfg.Port)
@@ -62,9 +62,9 @@ variable "allowed_origins" {
 }
 
 variable "token_duration" {
-  description = "JWT token expiration duration"
+  description = "JWT access token expiration duration"
   type        = string
-  default     = "24h"
+  default     = "15m"
 }
 
 variable "container_registry" {
@@ -91,8 +91,8 @@ variable "database_url" {
 }
 
 variable "token_duration" {
-  description = "JWT token expiration duration"
+  description = "JWT access token expiration duration"
   type        = string
-  default     = "24h"
+  default     = "15m"
 }
 
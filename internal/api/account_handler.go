@@ -0,0 +1,196 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/auth"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type AccountHandler struct {
+	userRepo        *repository.UserRepository
+	passwordService *service.PasswordService
+	accountService  *service.AccountService
+	userIDService   *service.UserIDService
+	guard           *service.BruteForceGuard
+	audit           *service.AuditRecorder
+}
+
+func NewAccountHandler(
+	userRepo *repository.UserRepository,
+	passwordService *service.PasswordService,
+	accountService *service.AccountService,
+	userIDService *service.UserIDService,
+	guard *service.BruteForceGuard,
+	audit *service.AuditRecorder,
+) *AccountHandler {
+	return &AccountHandler{
+		userRepo:        userRepo,
+		passwordService: passwordService,
+		accountService:  accountService,
+		userIDService:   userIDService,
+		guard:           guard,
+		audit:           audit,
+	}
+}
+
+// UpdateAccount changes the current user's user ID and/or display name
+func (h *AccountHandler) UpdateAccount(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		UserID      *string `json:"user_id"`
+		DisplayName *string `json:"display_name"`
+	}
+
+	if err := c.Bind(&req); err != nil || (req.UserID == nil && req.DisplayName == nil) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	if req.DisplayName != nil {
+		*req.DisplayName = strings.TrimSpace(*req.DisplayName)
+		if *req.DisplayName == "" || utf8.RuneCountInString(*req.DisplayName) > displayNameMaxLength {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Display name must be between 1 and 50 characters"})
+		}
+	}
+
+	// Change the user ID first, it is the part that can be refused
+	var user *models.User
+	if req.UserID != nil {
+		user, err = h.userIDService.Change(userUUID, *req.UserID)
+		if err != nil {
+			var userIDErr *service.UserIDError
+			if errors.As(err, &userIDErr) {
+				return userIDRejected(c, userIDErr)
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to change user ID"})
+		}
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditUserIDChange, UserID: &userUUID,
+			Account: user.UserID, Outcome: models.AuditSuccess})
+	}
+
+	if req.DisplayName != nil {
+		user, err = h.userRepo.UpdateDisplayName(userUUID, *req.DisplayName)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update display name"})
+		}
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// CheckUserIDAvailability tells whether a user ID can be registered or changed to
+func (h *AccountHandler) CheckUserIDAvailability(c echo.Context) error {
+	userID := c.QueryParam("user_id")
+	if userID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "user_id is required"})
+	}
+
+	normalized, err := h.userIDService.Check(userID, nil)
+	if err != nil {
+		var userIDErr *service.UserIDError
+		if !errors.As(err, &userIDErr) {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check user ID"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"user_id":   normalized,
+			"available": false,
+			"reason":    userIDErr.Reason,
+			"message":   userIDErr.Message,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"user_id":   normalized,
+		"available": true,
+	})
+}
+
+// DeleteAccount deletes the current user's account and all of their data,
+// after the configured grace period if there is one
+func (h *AccountHandler) DeleteAccount(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	// Get user
+	user, err := h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	// Re-confirm the password before anything is deleted. Accounts created
+	// through a login provider may not have one. Wrong passwords count towards
+	// the login lockout so a stolen access token can't be used to guess it.
+	if user.PasswordHash != "" {
+		lockout, err := h.guard.CheckAccount(user.UserID, &user.ID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+		}
+		if lockout > 0 {
+			return auth.TooManyRequests(c, lockout)
+		}
+
+		if err := h.passwordService.VerifyPassword(req.Password, user.PasswordHash); err != nil {
+			if _, err := h.guard.RecordFailure(user.UserID, &user.ID); err != nil {
+				c.Logger().Errorf("Failed to record login attempt: %v", err)
+			}
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Password is incorrect"})
+		}
+	}
+
+	scheduledFor, deleted, err := h.accountService.RequestDeletion(c.Request().Context(), userUUID)
+	if err != nil {
+		if scheduledFor.IsZero() {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete account"})
+		}
+		// The request is recorded, the scheduled purge will finish the job
+		c.Logger().Errorf("Account purge failed, will retry: %v", err)
+	}
+
+	if deleted {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Account deleted"})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"message":                "Account scheduled for deletion",
+		"deletion_scheduled_for": scheduledFor,
+	})
+}
+
+// CancelDeletion keeps an account whose deletion grace period has not ended
+func (h *AccountHandler) CancelDeletion(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	if err := h.accountService.CancelDeletion(userUUID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No pending deletion to cancel"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to cancel deletion"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account deletion cancelled"})
+}
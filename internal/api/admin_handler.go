@@ -0,0 +1,215 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type AdminHandler struct {
+	adminService *service.AdminService
+	audit        *service.AuditRecorder
+}
+
+func NewAdminHandler(adminService *service.AdminService, audit *service.AuditRecorder) *AdminHandler {
+	return &AdminHandler{
+		adminService: adminService,
+		audit:        audit,
+	}
+}
+
+type SuspendUserRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ListUsers searches users by q (user ID, display name or email), role and
+// suspended, with limit and offset
+func (h *AdminHandler) ListUsers(c echo.Context) error {
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+
+	filter := models.UserFilter{
+		Query:  c.QueryParam("q"),
+		Role:   c.QueryParam("role"),
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	if filter.Role != "" && !models.IsValidRole(filter.Role) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid role"})
+	}
+	if suspended := c.QueryParam("suspended"); suspended != "" {
+		parsed, err := strconv.ParseBool(suspended)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid suspended, use true or false"})
+		}
+		filter.Suspended = &parsed
+	}
+
+	users, total, err := h.adminService.ListUsers(filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get users"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"users": users,
+		"total": total,
+	})
+}
+
+// GetUser returns a user with their profile, session count and device count
+func (h *AdminHandler) GetUser(c echo.Context) error {
+	adminUUID, targetUUID, ok := h.adminAndTarget(c)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	details, err := h.adminService.GetUserDetails(c.Request().Context(), targetUUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get user"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{
+		EventType: models.AuditAdminUserView,
+		UserID:    &targetUUID,
+		ActorID:   &adminUUID,
+		Outcome:   models.AuditSuccess,
+	})
+
+	return c.JSON(http.StatusOK, details)
+}
+
+// SuspendUser blocks a user from logging in and signs them out everywhere
+func (h *AdminHandler) SuspendUser(c echo.Context) error {
+	adminUUID, targetUUID, ok := h.adminAndTarget(c)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	var req SuspendUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	// Admins can't lock themselves out
+	if targetUUID == adminUUID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cannot suspend your own account"})
+	}
+
+	if err := h.adminService.Suspend(targetUUID, adminUUID, req.Reason); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to suspend user"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{
+		EventType: models.AuditAdminSuspend,
+		UserID:    &targetUUID,
+		ActorID:   &adminUUID,
+		Outcome:   models.AuditSuccess,
+		Reason:    req.Reason,
+	})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "User suspended successfully"})
+}
+
+// UnsuspendUser lets a suspended user log in again
+func (h *AdminHandler) UnsuspendUser(c echo.Context) error {
+	adminUUID, targetUUID, ok := h.adminAndTarget(c)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	if err := h.adminService.Unsuspend(targetUUID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to unsuspend user"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{
+		EventType: models.AuditAdminUnsuspend,
+		UserID:    &targetUUID,
+		ActorID:   &adminUUID,
+		Outcome:   models.AuditSuccess,
+	})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "User unsuspended successfully"})
+}
+
+// ForcePasswordReset makes a user set a new password before they can log in with
+// one again, and emails them a reset link if they have a verified address
+func (h *AdminHandler) ForcePasswordReset(c echo.Context) error {
+	adminUUID, targetUUID, ok := h.adminAndTarget(c)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	sent, err := h.adminService.ForcePasswordReset(c.Request().Context(), targetUUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to force password reset"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{
+		EventType: models.AuditAdminForcePasswordReset,
+		UserID:    &targetUUID,
+		ActorID:   &adminUUID,
+		Outcome:   models.AuditSuccess,
+	})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":         "Password reset required",
+		"reset_link_sent": sent,
+	})
+}
+
+// RevokeTokens signs a user out everywhere and deletes their personal access
+// tokens
+func (h *AdminHandler) RevokeTokens(c echo.Context) error {
+	adminUUID, targetUUID, ok := h.adminAndTarget(c)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	if err := h.adminService.RevokeTokens(targetUUID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke tokens"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{
+		EventType: models.AuditAdminRevokeTokens,
+		UserID:    &targetUUID,
+		ActorID:   &adminUUID,
+		Outcome:   models.AuditSuccess,
+	})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Tokens revoked successfully"})
+}
+
+// adminAndTarget returns the acting admin and the user named in the path. It
+// reports false if the path doesn't hold a valid ID.
+func (h *AdminHandler) adminAndTarget(c echo.Context) (uuid.UUID, uuid.UUID, bool) {
+	adminUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, false
+	}
+	targetUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, false
+	}
+	return adminUUID, targetUUID, true
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type AuditHandler struct {
+	audit *service.AuditRecorder
+}
+
+func NewAuditHandler(audit *service.AuditRecorder) *AuditHandler {
+	return &AuditHandler{audit: audit}
+}
+
+// ListSecurityEvents returns the current user's own audit events
+func (h *AuditHandler) ListSecurityEvents(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	filter, err := auditFilterFromQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	filter.UserID = &userUUID
+	filter.IPAddress = ""
+
+	events, err := h.audit.List(filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get security events"})
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
+
+// ListEvents lets admins query the audit log across users
+func (h *AuditHandler) ListEvents(c echo.Context) error {
+	filter, err := auditFilterFromQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if userID := c.QueryParam("user_id"); userID != "" {
+		userUUID, err := uuid.Parse(userID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user_id"})
+		}
+		filter.UserID = &userUUID
+	}
+
+	events, err := h.audit.List(filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get audit events"})
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
+
+// auditFilterFromQuery reads event_type, outcome, ip_address, since, until
+// (RFC 3339), limit and offset
+func auditFilterFromQuery(c echo.Context) (models.AuditEventFilter, error) {
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+
+	filter := models.AuditEventFilter{
+		EventType: c.QueryParam("event_type"),
+		Outcome:   c.QueryParam("outcome"),
+		IPAddress: c.QueryParam("ip_address"),
+		Limit:     limit,
+		Offset:    offset,
+	}
+
+	if since := c.QueryParam("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, errors.New("Invalid since, use RFC 3339")
+		}
+		filter.Since = &parsed
+	}
+	if until := c.QueryParam("until"); until != "" {
+		parsed, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return filter, errors.New("Invalid until, use RFC 3339")
+		}
+		filter.Until = &parsed
+	}
+
+	return filter, nil
+}
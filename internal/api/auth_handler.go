@@ -1,31 +1,59 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/auth"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
 	"github.com/toof-jp/shisha-log-backend/internal/repository"
 	"github.com/toof-jp/shisha-log-backend/internal/service"
 )
 
+const displayNameMaxLength = 50
+
 type AuthHandler struct {
-	userRepo        *repository.UserRepository
-	passwordService *service.PasswordService
-	jwtService      *service.JWTService
+	userRepo            *repository.UserRepository
+	mfaRepo             *repository.MFARepository
+	passwordService     *service.PasswordService
+	userIDService       *service.UserIDService
+	tokenService        *service.TokenService
+	guard               *service.BruteForceGuard
+	notificationService *service.NotificationService
+	emailService        *service.EmailService
+	audit               *service.AuditRecorder
 }
 
 func NewAuthHandler(
 	userRepo *repository.UserRepository,
+	mfaRepo *repository.MFARepository,
 	passwordService *service.PasswordService,
-	jwtService *service.JWTService,
+	userIDService *service.UserIDService,
+	tokenService *service.TokenService,
+	guard *service.BruteForceGuard,
+	notificationService *service.NotificationService,
+	emailService *service.EmailService,
+	audit *service.AuditRecorder,
 ) *AuthHandler {
 	return &AuthHandler{
-		userRepo:        userRepo,
-		passwordService: passwordService,
-		jwtService:      jwtService,
+		userRepo:            userRepo,
+		mfaRepo:             mfaRepo,
+		passwordService:     passwordService,
+		userIDService:       userIDService,
+		tokenService:        tokenService,
+		guard:               guard,
+		notificationService: notificationService,
+		emailService:        emailService,
+		audit:               audit,
 	}
 }
 
@@ -35,21 +63,44 @@ func (h *AuthHandler) Register(c echo.Context) error {
 		UserID      string `json:"user_id" validate:"required,min=3,max=30"`
 		Password    string `json:"password" validate:"required,min=8"`
 		DisplayName string `json:"display_name" validate:"required"`
+		Email       string `json:"email"` // Optional contact address for password resets
 	}
 
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	// Validate password strength
-	if err := h.passwordService.ValidatePasswordStrength(req.Password); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	if req.Email != "" {
+		email, err := service.ParseEmail(req.Email)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email address"})
+		}
+		req.Email = email
+	}
+
+	req.DisplayName = strings.TrimSpace(req.DisplayName)
+	if req.DisplayName == "" || utf8.RuneCountInString(req.DisplayName) > displayNameMaxLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Display name must be between 1 and 50 characters"})
+	}
+
+	// Check the user ID is valid, not reserved and free
+	userID, err := h.userIDService.Check(req.UserID, nil)
+	if err != nil {
+		var userIDErr *service.UserIDError
+		if errors.As(err, &userIDErr) {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditRegister, Account: req.UserID,
+				Outcome: models.AuditFailure, Reason: "user_id_" + userIDErr.Reason})
+			return userIDRejected(c, userIDErr)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check user ID"})
 	}
+	req.UserID = userID
 
-	// Check if user already exists
-	_, err := h.userRepo.GetByUserID(req.UserID)
-	if err == nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "User ID already exists"})
+	// Validate password strength
+	if err := h.passwordService.ValidatePasswordStrength(req.Password, req.UserID, req.DisplayName); err != nil {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditRegister, Account: req.UserID,
+			Outcome: models.AuditFailure, Reason: "password_policy"})
+		return passwordRejected(c, err)
 	}
 
 	// Hash password
@@ -60,23 +111,39 @@ func (h *AuthHandler) Register(c echo.Context) error {
 
 	// Create user
 	user, err := h.userRepo.Create(req.UserID, passwordHash, req.DisplayName)
+	if err == repository.ErrDuplicate {
+		return userIDRejected(c, &service.UserIDError{Reason: service.UserIDTaken, Message: "User ID already exists"})
+	}
 	if err != nil {
 		// Log the actual error for debugging
 		c.Logger().Errorf("Failed to create user: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user", "details": err.Error()})
 	}
 
-	// Generate JWT token
-	token, err := h.jwtService.GenerateToken(user.ID.String())
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditRegister, UserID: &user.ID, Account: req.UserID,
+		Outcome: models.AuditSuccess})
+
+	// The address is only attached once the link sent to it has been opened
+	if req.Email != "" {
+		logger := c.Logger()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if _, err := h.emailService.RequestChange(ctx, user, req.Email); err != nil {
+				logger.Errorf("Failed to send verification email: %v", err)
+			}
+		}()
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := h.tokenService.IssueTokens(user, clientInfo(c))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		return tokensNotIssued(c, err)
 	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"user":    user,
-		"token":   token,
-		"message": "Registration successful",
-	})
+	response := tokenResponse(user, tokens)
+	response["message"] = "Registration successful"
+	return c.JSON(http.StatusCreated, response)
 }
 
 // Login handles user login
@@ -90,30 +157,191 @@ func (h *AuthHandler) Login(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	// Get user by user_id
-	user, err := h.userRepo.GetByUserID(req.UserID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid user ID or password"})
-		}
+	// Get user by user_id, or the one it was recently changed from
+	user, err := h.userIDService.Lookup(req.UserID)
+	if err != nil && err != sql.ErrNoRows {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
 	}
+	var userID *uuid.UUID
+	if user != nil {
+		userID = &user.ID
+	}
+
+	// Reject attempts while the account is locked out
+	lockout, err := h.guard.CheckAccount(req.UserID, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+	}
+	if lockout > 0 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogin, UserID: userID, Account: req.UserID,
+			Outcome: models.AuditFailure, Reason: "locked_out"})
+		return auth.TooManyRequests(c, lockout)
+	}
+
+	if user == nil {
+		return h.loginFailed(c, req.UserID, nil, "unknown_user")
+	}
 
 	// Verify password
 	if err := h.passwordService.VerifyPassword(req.Password, user.PasswordHash); err != nil {
+		return h.loginFailed(c, req.UserID, &user.ID, "invalid_password")
+	}
+
+	// Upgrade hashes made with an older algorithm or parameters while we have the password
+	if h.passwordService.NeedsRehash(user.PasswordHash) {
+		if newHash, err := h.passwordService.HashPassword(req.Password); err != nil {
+			c.Logger().Errorf("Failed to rehash password: %v", err)
+		} else if err := h.userRepo.UpdatePasswordHash(user.ID, user.PasswordHash, newHash); err != nil {
+			c.Logger().Errorf("Failed to store rehashed password: %v", err)
+		}
+	}
+
+	// Accounts past their deletion grace period are waiting to be purged. The
+	// password was right, so this doesn't count towards a lockout.
+	if user.DeletionScheduledFor != nil && !user.DeletionScheduledFor.After(time.Now()) {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogin, UserID: &user.ID, Account: req.UserID,
+			Outcome: models.AuditFailure, Reason: "pending_deletion"})
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid user ID or password"})
 	}
 
-	// Generate JWT token
-	token, err := h.jwtService.GenerateToken(user.ID.String())
+	// Suspended accounts can't log in at all
+	if user.SuspendedAt != nil {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogin, UserID: &user.ID, Account: req.UserID,
+			Outcome: models.AuditFailure, Reason: "suspended"})
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Account suspended"})
+	}
+
+	// An admin may require a new password, set through a reset link or another login method
+	if user.PasswordResetRequired {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogin, UserID: &user.ID, Account: req.UserID,
+			Outcome: models.AuditFailure, Reason: "password_reset_required"})
+		return c.JSON(http.StatusForbidden, map[string]interface{}{
+			"error":                   "Password reset required",
+			"password_reset_required": true,
+		})
+	}
+
+	// Accounts with two-factor authentication finish logging in at /auth/login/mfa
+	mfaEnabled, err := h.mfaRepo.IsEnabled(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get two-factor status"})
+	}
+	if mfaEnabled {
+		mfaToken, err := h.tokenService.IssueMFAToken(user)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		}
+
+		// The password was right; the login completes with a login_mfa event
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogin, UserID: &user.ID, Account: req.UserID,
+			Outcome: models.AuditSuccess, Reason: "mfa_required"})
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"methods":      []string{"totp", "recovery_code"},
+		})
+	}
+
+	if err := h.guard.RecordSuccess(req.UserID, &user.ID); err != nil {
+		c.Logger().Errorf("Failed to reset login attempts: %v", err)
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := h.tokenService.IssueTokens(user, clientInfo(c))
+	if err != nil {
+		return tokensNotIssued(c, err)
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogin, UserID: &user.ID, Account: req.UserID,
+		Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, tokenResponse(user, tokens))
+}
+
+// loginFailed counts a failed login against the account, records why it failed
+// and responds with 401
+func (h *AuthHandler) loginFailed(c echo.Context, account string, userID *uuid.UUID, reason string) error {
+	if _, err := h.guard.RecordFailure(account, userID); err != nil {
+		c.Logger().Errorf("Failed to record login attempt: %v", err)
+	}
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogin, UserID: userID, Account: account,
+		Outcome: models.AuditFailure, Reason: reason})
+	return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid user ID or password"})
+}
+
+// Refresh exchanges a refresh token for a new access token and a rotated refresh token
+func (h *AuthHandler) Refresh(c echo.Context) error {
+	var req struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.RefreshToken == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	tokens, user, err := h.tokenService.Refresh(req.RefreshToken, clientInfo(c))
+	if err != nil {
+		switch err {
+		case service.ErrRefreshTokenReused:
+			// Successful refreshes happen every few minutes on every device and
+			// aren't recorded, but reuse means a refresh token was stolen
+			c.Logger().Warnf("Refresh token reuse detected, token family revoked")
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditRefresh, Outcome: models.AuditFailure,
+				Reason: "refresh_token_reused"})
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired refresh token"})
+		case service.ErrInvalidRefreshToken:
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired refresh token"})
+		case service.ErrAccountSuspended:
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Account suspended"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to refresh token"})
+	}
+
+	return c.JSON(http.StatusOK, tokenResponse(user, tokens))
+}
+
+// Logout revokes the current access token and signs out the current device
+func (h *AuthHandler) Logout(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	tokenID := c.Get("token_id").(string)
+	expiresAt := c.Get("token_expires_at").(time.Time)
+	sessionID := c.Get("session_id").(string)
+	if err := h.tokenService.Logout(userUUID, tokenID, expiresAt, sessionID, req.RefreshToken); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to log out"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogout, UserID: &userUUID, Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Logged out successfully"})
+}
+
+// LogoutAll revokes every token issued to the current user on any device
+func (h *AuthHandler) LogoutAll(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"user":  user,
-		"token": token,
-	})
+	if err := h.tokenService.LogoutAll(userUUID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to log out"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLogoutAll, UserID: &userUUID, Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Logged out from all devices"})
 }
 
 // RequestPasswordReset handles password reset requests
@@ -126,11 +354,33 @@ func (h *AuthHandler) RequestPasswordReset(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	// Get user by user_id
-	user, err := h.userRepo.GetByUserID(req.UserID)
+	// Throttle per requested user ID, whether or not it exists
+	wait, err := h.guard.CheckPasswordReset(req.UserID)
 	if err != nil {
-		// Don't reveal if user ID exists
-		return c.JSON(http.StatusOK, map[string]string{"message": "If the user ID exists, a reset token has been generated"})
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check reset attempts"})
+	}
+	if wait > 0 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordResetRequest, Account: req.UserID,
+			Outcome: models.AuditFailure, Reason: "rate_limited"})
+		return auth.TooManyRequests(c, wait)
+	}
+
+	// Don't reveal whether the user ID exists or has a verified address
+	response := map[string]string{"message": "If the account has a verified email address, a reset link has been sent"}
+
+	// Get user by user_id, or the one it was recently changed from
+	user, err := h.userIDService.Lookup(req.UserID)
+	if err != nil {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordResetRequest, Account: req.UserID,
+			Outcome: models.AuditFailure, Reason: "unknown_user"})
+		return c.JSON(http.StatusOK, response)
+	}
+
+	// Reset links can only be delivered to a verified address
+	if user.Email == nil || user.EmailVerifiedAt == nil {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordResetRequest, UserID: &user.ID,
+			Account: req.UserID, Outcome: models.AuditFailure, Reason: "no_verified_email"})
+		return c.JSON(http.StatusOK, response)
 	}
 
 	// Generate reset token
@@ -139,16 +389,26 @@ func (h *AuthHandler) RequestPasswordReset(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate reset token"})
 	}
 
-	// Store reset token
-	expiresAt := time.Now().Add(1 * time.Hour)
-	if err := h.userRepo.CreatePasswordResetToken(user.ID, resetToken, expiresAt); err != nil {
+	// Store only the hash of the reset token
+	expiresAt := time.Now().Add(service.PasswordResetTTL)
+	if err := h.userRepo.CreatePasswordResetToken(user.ID, service.HashToken(resetToken), expiresAt); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create reset token"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message":     "If the user ID exists, a reset token has been generated",
-		"reset_token": resetToken, // In production, this would be sent via secure channel
-	})
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordResetRequest, UserID: &user.ID,
+		Account: req.UserID, Outcome: models.AuditSuccess})
+
+	// Send in the background so the response time doesn't reveal whether a message was sent
+	logger := c.Logger()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := h.notificationService.SendPasswordReset(ctx, user, resetToken, service.PasswordResetTTL); err != nil {
+			logger.Errorf("Failed to send password reset email: %v", err)
+		}
+	}()
+
+	return c.JSON(http.StatusOK, response)
 }
 
 // ResetPassword handles password reset
@@ -162,18 +422,23 @@ func (h *AuthHandler) ResetPassword(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	// Validate password strength
-	if err := h.passwordService.ValidatePasswordStrength(req.NewPassword); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
-	}
-
-	// Get reset token
-	resetToken, err := h.userRepo.GetPasswordResetToken(req.Token)
+	// Look up the account so the password can be checked against its user ID and name
+	tokenHash := service.HashToken(req.Token)
+	user, err := h.userRepo.GetByPasswordResetToken(tokenHash)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordReset, Outcome: models.AuditFailure,
+				Reason: "invalid_token"})
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
 		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify token"})
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
+	}
+
+	// Validate password strength
+	if err := h.passwordService.ValidatePasswordStrength(req.NewPassword, user.UserID, user.DisplayName); err != nil {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordReset, UserID: &user.ID,
+			Outcome: models.AuditFailure, Reason: "password_policy"})
+		return passwordRejected(c, err)
 	}
 
 	// Hash new password
@@ -182,16 +447,22 @@ func (h *AuthHandler) ResetPassword(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to process password"})
 	}
 
-	// Update password
-	if err := h.userRepo.UpdatePassword(resetToken.UserID, passwordHash); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update password"})
+	// Use up the token and update the password together
+	userUUID, err := h.userRepo.ConsumePasswordResetToken(tokenHash, passwordHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
 	}
 
-	// Mark token as used
-	if err := h.userRepo.MarkPasswordResetTokenUsed(req.Token); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to mark token as used"})
+	// Sign out every device that was using the old password
+	if err := h.tokenService.RevokeRefreshTokens(userUUID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke existing sessions"})
 	}
 
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordReset, UserID: &userUUID, Outcome: models.AuditSuccess})
+
 	return c.JSON(http.StatusOK, map[string]string{"message": "Password reset successfully"})
 }
 
@@ -204,28 +475,36 @@ func (h *AuthHandler) ChangePassword(c echo.Context) error {
 	}
 
 	var req struct {
-		CurrentPassword string `json:"current_password" validate:"required"`
+		CurrentPassword string `json:"current_password"` // Not needed when setting a first password
 		NewPassword     string `json:"new_password" validate:"required,min=8"`
+		KeepSignedIn    bool   `json:"keep_signed_in"` // Return fresh tokens for the current device
 	}
 
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	// Validate new password strength
-	if err := h.passwordService.ValidatePasswordStrength(req.NewPassword); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
-	}
-
 	// Get user
 	user, err := h.userRepo.GetByID(userUUID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
 	}
 
-	// Verify current password
-	if err := h.passwordService.VerifyPassword(req.CurrentPassword, user.PasswordHash); err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Current password is incorrect"})
+	// Verify current password. Accounts created through a login provider have
+	// none until they set their first one here.
+	if user.PasswordHash != "" {
+		if err := h.passwordService.VerifyPassword(req.CurrentPassword, user.PasswordHash); err != nil {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordChange, UserID: &userUUID,
+				Outcome: models.AuditFailure, Reason: "invalid_password"})
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Current password is incorrect"})
+		}
+	}
+
+	// Validate new password strength
+	if err := h.passwordService.ValidatePasswordStrength(req.NewPassword, user.UserID, user.DisplayName); err != nil {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordChange, UserID: &userUUID,
+			Outcome: models.AuditFailure, Reason: "password_policy"})
+		return passwordRejected(c, err)
 	}
 
 	// Hash new password
@@ -239,7 +518,31 @@ func (h *AuthHandler) ChangePassword(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update password"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Password changed successfully"})
+	// Sign out every device, including this one unless asked to keep it signed in
+	if err := h.tokenService.RevokeRefreshTokens(userUUID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke existing sessions"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasswordChange, UserID: &userUUID, Outcome: models.AuditSuccess})
+
+	if !req.KeepSignedIn {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Password changed successfully"})
+	}
+
+	// Reload the user to pick up the new token version
+	user, err = h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	tokens, err := h.tokenService.IssueTokens(user, clientInfo(c))
+	if err != nil {
+		return tokensNotIssued(c, err)
+	}
+
+	response := tokenResponse(user, tokens)
+	response["message"] = "Password changed successfully"
+	return c.JSON(http.StatusOK, response)
 }
 
 // GetCurrentUser returns the current authenticated user's information
@@ -261,3 +564,64 @@ func (h *AuthHandler) GetCurrentUser(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, user)
 }
+
+// passwordRejected responds with the password policy rule a new password broke
+func passwordRejected(c echo.Context, err error) error {
+	var policyErr *service.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": policyErr.Message, "rule": policyErr.Rule})
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+// tokensNotIssued responds to a failure to issue tokens to a user who proved
+// who they are
+func tokensNotIssued(c echo.Context, err error) error {
+	if err == service.ErrAccountSuspended {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Account suspended"})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+}
+
+// userIDRejected responds with the reason a user ID can't be used
+func userIDRejected(c echo.Context, err *service.UserIDError) error {
+	switch err.Reason {
+	case service.UserIDTaken, service.UserIDHeld:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Message, "reason": err.Reason})
+	case service.UserIDCooldown:
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(err.RetryAt).Seconds()))))
+		return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+			"error":    err.Message,
+			"reason":   err.Reason,
+			"retry_at": err.RetryAt,
+		})
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Message, "reason": err.Reason})
+}
+
+// recordAudit writes an event to the audit log with the client's details. A
+// failure to record is logged rather than failing the request.
+func recordAudit(c echo.Context, recorder *service.AuditRecorder, entry service.AuditEntry) {
+	entry.Client = clientInfo(c)
+	if err := recorder.Record(entry); err != nil {
+		c.Logger().Errorf("Failed to record %s audit event: %v", entry.EventType, err)
+	}
+}
+
+// clientInfo describes the client making the request for the device list
+func clientInfo(c echo.Context) service.ClientInfo {
+	return service.ClientInfo{
+		UserAgent: c.Request().UserAgent(),
+		IPAddress: c.RealIP(),
+	}
+}
+
+// tokenResponse builds the body returned whenever a user is signed in
+func tokenResponse(user *models.User, tokens *service.TokenPair) map[string]interface{} {
+	return map[string]interface{}{
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	}
+}
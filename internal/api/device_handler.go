@@ -0,0 +1,61 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type DeviceHandler struct {
+	tokenService *service.TokenService
+}
+
+func NewDeviceHandler(tokenService *service.TokenService) *DeviceHandler {
+	return &DeviceHandler{tokenService: tokenService}
+}
+
+// ListDevices returns every device the current user is signed in on
+func (h *DeviceHandler) ListDevices(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	devices, err := h.tokenService.ListDevices(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get devices"})
+	}
+
+	// Mark the device making this request
+	sessionID := c.Get("session_id").(string)
+	for i := range devices {
+		devices[i].Current = devices[i].ID.String() == sessionID
+	}
+
+	return c.JSON(http.StatusOK, devices)
+}
+
+// RevokeDevice signs out one of the current user's devices
+func (h *DeviceHandler) RevokeDevice(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	deviceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Device not found"})
+	}
+
+	if err := h.tokenService.RevokeDevice(userUUID, deviceID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Device not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to sign out device"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Device signed out successfully"})
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/auth"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type EmailHandler struct {
+	userRepo        *repository.UserRepository
+	passwordService *service.PasswordService
+	emailService    *service.EmailService
+	guard           *service.BruteForceGuard
+	audit           *service.AuditRecorder
+}
+
+func NewEmailHandler(
+	userRepo *repository.UserRepository,
+	passwordService *service.PasswordService,
+	emailService *service.EmailService,
+	guard *service.BruteForceGuard,
+	audit *service.AuditRecorder,
+) *EmailHandler {
+	return &EmailHandler{
+		userRepo:        userRepo,
+		passwordService: passwordService,
+		emailService:    emailService,
+		guard:           guard,
+		audit:           audit,
+	}
+}
+
+// SetEmail sends a verification link to a new contact address. The address is
+// only attached to the account once the link has been opened and, when it
+// replaces a verified address, once the current address has confirmed too.
+func (h *EmailHandler) SetEmail(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	email, err := service.ParseEmail(req.Email)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email address"})
+	}
+
+	// Get user
+	user, err := h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	// The contact address controls password resets, so require the password.
+	// Accounts created through a login provider may not have one. Wrong
+	// passwords count towards the login lockout.
+	if user.PasswordHash != "" {
+		lockout, err := h.guard.CheckAccount(user.UserID, &user.ID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+		}
+		if lockout > 0 {
+			return auth.TooManyRequests(c, lockout)
+		}
+
+		if err := h.passwordService.VerifyPassword(req.Password, user.PasswordHash); err != nil {
+			if _, err := h.guard.RecordFailure(user.UserID, &user.ID); err != nil {
+				c.Logger().Errorf("Failed to record login attempt: %v", err)
+			}
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Password is incorrect"})
+		}
+	}
+
+	if user.Email != nil && strings.EqualFold(*user.Email, email) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email address is already verified"})
+	}
+
+	confirmCurrent, err := h.emailService.RequestChange(c.Request().Context(), user, email)
+	if err != nil {
+		var tooSoon *service.EmailResendTooSoonError
+		if errors.As(err, &tooSoon) {
+			return auth.TooManyRequests(c, tooSoon.Wait)
+		}
+		c.Logger().Errorf("Failed to send verification email: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send verification email"})
+	}
+
+	if confirmCurrent {
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"message":         "Confirmation emails sent to the new and the current address",
+			"confirm_current": true,
+		})
+	}
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"message":         "Verification email sent",
+		"confirm_current": false,
+	})
+}
+
+// ResendVerification sends the links of the pending address change again
+func (h *EmailHandler) ResendVerification(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	// Get user
+	user, err := h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	if err := h.emailService.Resend(c.Request().Context(), user); err != nil {
+		var tooSoon *service.EmailResendTooSoonError
+		switch {
+		case errors.Is(err, service.ErrNoPendingEmailVerification):
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No pending email verification"})
+		case errors.As(err, &tooSoon):
+			return auth.TooManyRequests(c, tooSoon.Wait)
+		}
+		c.Logger().Errorf("Failed to resend verification email: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send verification email"})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{"message": "Verification email sent"})
+}
+
+// VerifyEmail confirms an address using the token from a verification link
+func (h *EmailHandler) VerifyEmail(c echo.Context) error {
+	var req struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	token, completed, err := h.emailService.Confirm(req.Token)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+		}
+		if err == repository.ErrDuplicate {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Email address is already in use"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify email"})
+	}
+
+	// A change of a verified address waits for the link sent to the other address
+	if !completed {
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"message":   "Confirmed, the link sent to the other address has to be opened too",
+			"completed": false,
+		})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditEmailChange, UserID: &token.UserID,
+		Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":   "Email verified successfully",
+		"completed": true,
+	})
+}
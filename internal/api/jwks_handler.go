@@ -0,0 +1,24 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type JWKSHandler struct {
+	jwtService *service.JWTService
+}
+
+func NewJWKSHandler(jwtService *service.JWTService) *JWKSHandler {
+	return &JWKSHandler{jwtService: jwtService}
+}
+
+// GetJWKS publishes the public keys other services use to verify access tokens
+func (h *JWKSHandler) GetJWKS(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"keys": h.jwtService.PublicKeys(),
+	})
+}
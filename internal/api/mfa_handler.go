@@ -0,0 +1,436 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/auth"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type MFAHandler struct {
+	userRepo        *repository.UserRepository
+	mfaRepo         *repository.MFARepository
+	totpService     *service.TOTPService
+	passwordService *service.PasswordService
+	tokenService    *service.TokenService
+	guard           *service.BruteForceGuard
+	audit           *service.AuditRecorder
+}
+
+func NewMFAHandler(
+	userRepo *repository.UserRepository,
+	mfaRepo *repository.MFARepository,
+	totpService *service.TOTPService,
+	passwordService *service.PasswordService,
+	tokenService *service.TokenService,
+	guard *service.BruteForceGuard,
+	audit *service.AuditRecorder,
+) *MFAHandler {
+	return &MFAHandler{
+		userRepo:        userRepo,
+		mfaRepo:         mfaRepo,
+		totpService:     totpService,
+		passwordService: passwordService,
+		tokenService:    tokenService,
+		guard:           guard,
+		audit:           audit,
+	}
+}
+
+// VerifyLogin completes a login started with a password by exchanging the MFA
+// token and a TOTP or recovery code for access and refresh tokens
+func (h *MFAHandler) VerifyLogin(c echo.Context) error {
+	var req struct {
+		MFAToken     string `json:"mfa_token" validate:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	user, err := h.tokenService.VerifyMFAToken(req.MFAToken)
+	if err != nil {
+		if err == service.ErrInvalidMFAToken {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginMFA, Outcome: models.AuditFailure,
+				Reason: "invalid_mfa_token"})
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired MFA token"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify MFA token"})
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	lockout, err := h.guard.CheckAccount(user.UserID, &user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+	}
+	if lockout > 0 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginMFA, UserID: &user.ID, Account: user.UserID,
+			Outcome: models.AuditFailure, Reason: "locked_out"})
+		return auth.TooManyRequests(c, lockout)
+	}
+
+	if err := h.verifySecondFactor(user.ID, req.Code, req.RecoveryCode); err != nil {
+		if err == service.ErrInvalidTOTPCode {
+			if _, err := h.guard.RecordFailure(user.UserID, &user.ID); err != nil {
+				c.Logger().Errorf("Failed to record login attempt: %v", err)
+			}
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginMFA, UserID: &user.ID, Account: user.UserID,
+				Outcome: models.AuditFailure, Reason: "invalid_code"})
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authentication code"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify authentication code"})
+	}
+
+	if err := h.guard.RecordSuccess(user.UserID, &user.ID); err != nil {
+		c.Logger().Errorf("Failed to reset login attempts: %v", err)
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := h.tokenService.IssueTokens(user, clientInfo(c))
+	if err != nil {
+		return tokensNotIssued(c, err)
+	}
+
+	reason := "totp"
+	if req.RecoveryCode != "" {
+		reason = "recovery_code"
+	}
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginMFA, UserID: &user.ID, Account: user.UserID,
+		Outcome: models.AuditSuccess, Reason: reason})
+
+	return c.JSON(http.StatusOK, tokenResponse(user, tokens))
+}
+
+// GetStatus reports whether two-factor authentication is enabled
+func (h *MFAHandler) GetStatus(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	enabled, err := h.mfaRepo.IsEnabled(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get two-factor status"})
+	}
+
+	remaining := 0
+	if enabled {
+		remaining, err = h.mfaRepo.CountUnusedRecoveryCodes(userUUID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get two-factor status"})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"totp_enabled":             enabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollTOTP generates a new secret. It is not used for login until confirmed.
+func (h *MFAHandler) EnrollTOTP(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	user, err := h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	secret, err := h.totpService.GenerateSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate secret"})
+	}
+
+	encrypted, err := h.totpService.EncryptSecret(secret)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate secret"})
+	}
+
+	// Only an unconfirmed secret can be replaced
+	if err := h.mfaRepo.SavePendingTOTP(userUUID, encrypted); err != nil {
+		if err == sql.ErrNoRows {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditMFAEnroll, UserID: &userUUID,
+				Outcome: models.AuditFailure, Reason: "already_enabled"})
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Two-factor authentication is already enabled"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store secret"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditMFAEnroll, UserID: &userUUID, Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": h.totpService.ProvisioningURI(secret, user.UserID),
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves their
+// authenticator app produces valid codes, and returns the recovery codes
+func (h *MFAHandler) ConfirmTOTP(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	mfa, err := h.mfaRepo.GetByUserID(userUUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No pending two-factor enrollment"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get two-factor status"})
+	}
+
+	if mfa.EnabledAt != nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Two-factor authentication is already enabled"})
+	}
+
+	// Get user
+	user, err := h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	// Wrong codes count towards the login lockout
+	lockout, err := h.guard.CheckAccount(user.UserID, &user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+	}
+	if lockout > 0 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditMFAEnable, UserID: &userUUID,
+			Outcome: models.AuditFailure, Reason: "locked_out"})
+		return auth.TooManyRequests(c, lockout)
+	}
+
+	if err := h.verifyTOTP(userUUID, mfa.TOTPSecret, mfa.LastUsedStep, req.Code); err != nil {
+		if err == service.ErrInvalidTOTPCode {
+			h.secondFactorFailed(c, user, models.AuditMFAEnable, "invalid_code")
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid authentication code"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify authentication code"})
+	}
+
+	codes, hashes, err := h.totpService.GenerateRecoveryCodes()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate recovery codes"})
+	}
+
+	if err := h.mfaRepo.Enable(userUUID, hashes); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Two-factor authentication is already enabled"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to enable two-factor authentication"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditMFAEnable, UserID: &userUUID, Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes, // Only shown once
+	})
+}
+
+// DisableTOTP turns off two-factor authentication. It requires a current code
+// or recovery code, and the password if the account has one. Wrong passwords
+// and codes count towards the login lockout.
+func (h *MFAHandler) DisableTOTP(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	if err := c.Bind(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	// Get user
+	user, err := h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	// Accounts created through a login provider have no password
+	hasPassword := user.PasswordHash != ""
+	if hasPassword && req.Password == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password is required"})
+	}
+
+	lockout, err := h.guard.CheckAccount(user.UserID, &user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+	}
+	if lockout > 0 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditMFADisable, UserID: &userUUID,
+			Outcome: models.AuditFailure, Reason: "locked_out"})
+		return auth.TooManyRequests(c, lockout)
+	}
+
+	// Verify password
+	if hasPassword {
+		if err := h.passwordService.VerifyPassword(req.Password, user.PasswordHash); err != nil {
+			h.secondFactorFailed(c, user, models.AuditMFADisable, "invalid_password")
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Password is incorrect"})
+		}
+	}
+
+	if err := h.verifySecondFactor(userUUID, req.Code, req.RecoveryCode); err != nil {
+		if err == service.ErrInvalidTOTPCode {
+			h.secondFactorFailed(c, user, models.AuditMFADisable, "invalid_code")
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authentication code"})
+		}
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Two-factor authentication is not enabled"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify authentication code"})
+	}
+
+	if err := h.mfaRepo.Disable(userUUID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to disable two-factor authentication"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditMFADisable, UserID: &userUUID, Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// secondFactorFailed counts a wrong password or code given to change two-factor
+// settings against the login lockout and records why it failed
+func (h *MFAHandler) secondFactorFailed(c echo.Context, user *models.User, eventType, reason string) {
+	if _, err := h.guard.RecordFailure(user.UserID, &user.ID); err != nil {
+		c.Logger().Errorf("Failed to record login attempt: %v", err)
+	}
+	recordAudit(c, h.audit, service.AuditEntry{EventType: eventType, UserID: &user.ID,
+		Outcome: models.AuditFailure, Reason: reason})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes. A current TOTP code is
+// required so a stolen recovery code cannot be used to mint new ones.
+func (h *MFAHandler) RegenerateRecoveryCodes(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	// Get user
+	user, err := h.userRepo.GetByID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	// Wrong codes count towards the login lockout
+	lockout, err := h.guard.CheckAccount(user.UserID, &user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+	}
+	if lockout > 0 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditRecoveryCodesRegenerate, UserID: &userUUID,
+			Outcome: models.AuditFailure, Reason: "locked_out"})
+		return auth.TooManyRequests(c, lockout)
+	}
+
+	if err := h.verifySecondFactor(userUUID, req.Code, ""); err != nil {
+		if err == service.ErrInvalidTOTPCode {
+			h.secondFactorFailed(c, user, models.AuditRecoveryCodesRegenerate, "invalid_code")
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authentication code"})
+		}
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Two-factor authentication is not enabled"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify authentication code"})
+	}
+
+	codes, hashes, err := h.totpService.GenerateRecoveryCodes()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate recovery codes"})
+	}
+
+	if err := h.mfaRepo.ReplaceRecoveryCodes(userUUID, hashes); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store recovery codes"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditRecoveryCodesRegenerate, UserID: &userUUID,
+		Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"recovery_codes": codes, // Only shown once
+	})
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code when one is given,
+// for a user with two-factor authentication enabled. It returns sql.ErrNoRows
+// if it is not enabled and service.ErrInvalidTOTPCode if the code is wrong.
+func (h *MFAHandler) verifySecondFactor(userID uuid.UUID, code, recoveryCode string) error {
+	mfa, err := h.mfaRepo.GetByUserID(userID)
+	if err != nil {
+		return err
+	}
+	if mfa.EnabledAt == nil {
+		return sql.ErrNoRows
+	}
+
+	if recoveryCode != "" {
+		if err := h.mfaRepo.ConsumeRecoveryCode(userID, service.HashRecoveryCode(recoveryCode)); err != nil {
+			if err == sql.ErrNoRows {
+				return service.ErrInvalidTOTPCode
+			}
+			return err
+		}
+		return nil
+	}
+
+	return h.verifyTOTP(userID, mfa.TOTPSecret, mfa.LastUsedStep, code)
+}
+
+// verifyTOTP checks a code against the stored secret and burns its time step
+func (h *MFAHandler) verifyTOTP(userID uuid.UUID, encryptedSecret string, lastUsedStep int64, code string) error {
+	secret, err := h.totpService.DecryptSecret(encryptedSecret)
+	if err != nil {
+		return err
+	}
+
+	step, err := h.totpService.Validate(secret, code, lastUsedStep)
+	if err != nil {
+		return service.ErrInvalidTOTPCode
+	}
+
+	// Another request may have used the same code concurrently
+	if err := h.mfaRepo.UseStep(userID, step); err != nil {
+		if err == sql.ErrNoRows {
+			return service.ErrInvalidTOTPCode
+		}
+		return err
+	}
+
+	return nil
+}
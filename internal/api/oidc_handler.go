@@ -0,0 +1,228 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+// oidcStateCookie ties an authorization request to the browser that started it,
+// so a callback can't be completed with a state issued to someone else
+const (
+	oidcStateCookie     = "oidc_state"
+	oidcStateCookiePath = "/api/v1/auth/oidc"
+)
+
+type OIDCHandler struct {
+	oidcService  *service.OIDCService
+	mfaRepo      *repository.MFARepository
+	tokenService *service.TokenService
+	audit        *service.AuditRecorder
+}
+
+func NewOIDCHandler(
+	oidcService *service.OIDCService,
+	mfaRepo *repository.MFARepository,
+	tokenService *service.TokenService,
+	audit *service.AuditRecorder,
+) *OIDCHandler {
+	return &OIDCHandler{
+		oidcService:  oidcService,
+		mfaRepo:      mfaRepo,
+		tokenService: tokenService,
+		audit:        audit,
+	}
+}
+
+// ListProviders returns the providers users can log in with
+func (h *OIDCHandler) ListProviders(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string][]string{"providers": h.oidcService.Providers()})
+}
+
+// Authorize starts a login with a provider
+func (h *OIDCHandler) Authorize(c echo.Context) error {
+	return h.beginAuthorization(c, nil)
+}
+
+// Link starts linking a provider account to the authenticated user
+func (h *OIDCHandler) Link(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	return h.beginAuthorization(c, &userUUID)
+}
+
+func (h *OIDCHandler) beginAuthorization(c echo.Context, linkUserID *uuid.UUID) error {
+	authorizationURL, state, err := h.oidcService.BeginAuthorization(c.Request().Context(), c.Param("provider"), linkUserID)
+	if err != nil {
+		if err == service.ErrUnknownOIDCProvider {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown login provider"})
+		}
+		c.Logger().Errorf("Failed to start %s authorization: %v", c.Param("provider"), err)
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Failed to contact login provider"})
+	}
+
+	c.SetCookie(h.stateCookie(c, state, int(service.OIDCStateTTL.Seconds())))
+	return c.JSON(http.StatusOK, map[string]string{"authorization_url": authorizationURL})
+}
+
+func (h *OIDCHandler) stateCookie(c echo.Context, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     oidcStateCookiePath,
+		MaxAge:   maxAge,
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Callback completes a login or link with the code the provider returned
+func (h *OIDCHandler) Callback(c echo.Context) error {
+	var req struct {
+		Code  string `json:"code" form:"code" validate:"required"`
+		State string `json:"state" form:"state" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.Code == "" || req.State == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	// The state must come back to the browser that started the request
+	provider := c.Param("provider")
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(req.State)) != 1 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginOIDC, Outcome: models.AuditFailure,
+			Reason: "state_mismatch"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired authorization request"})
+	}
+	c.SetCookie(h.stateCookie(c, "", -1))
+
+	user, linked, err := h.oidcService.CompleteAuthorization(c.Request().Context(), provider, req.State, req.Code)
+	if err != nil {
+		eventType := models.AuditLoginOIDC
+		if linked {
+			eventType = models.AuditOIDCLink
+		}
+		failed := func(reason string) {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: eventType, Outcome: models.AuditFailure, Reason: reason})
+		}
+
+		switch err {
+		case service.ErrUnknownOIDCProvider:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown login provider"})
+		case service.ErrInvalidOIDCState:
+			failed("invalid_state")
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired authorization request"})
+		case service.ErrOIDCIdentityInUse:
+			failed("identity_in_use")
+			return c.JSON(http.StatusConflict, map[string]string{"error": "This account is already linked to another user"})
+		}
+		c.Logger().Warnf("%s login failed: %v", provider, err)
+		failed("provider_error")
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Login with provider failed"})
+	}
+
+	if linked {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditOIDCLink, UserID: &user.ID,
+			Outcome: models.AuditSuccess, Reason: provider})
+		return c.JSON(http.StatusOK, map[string]string{"message": "Account linked"})
+	}
+
+	// Accounts past their deletion grace period are waiting to be purged
+	if user.DeletionScheduledFor != nil && !user.DeletionScheduledFor.After(time.Now()) {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginOIDC, UserID: &user.ID, Account: user.UserID,
+			Outcome: models.AuditFailure, Reason: "pending_deletion"})
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Login with provider failed"})
+	}
+
+	// Accounts with two-factor authentication finish logging in at /auth/login/mfa
+	mfaEnabled, err := h.mfaRepo.IsEnabled(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get two-factor status"})
+	}
+	if mfaEnabled {
+		mfaToken, err := h.tokenService.IssueMFAToken(user)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		}
+
+		// The login completes with a login_mfa event
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginOIDC, UserID: &user.ID, Account: user.UserID,
+			Outcome: models.AuditSuccess, Reason: "mfa_required"})
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"methods":      []string{"totp", "recovery_code"},
+		})
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := h.tokenService.IssueTokens(user, clientInfo(c))
+	if err != nil {
+		if err == service.ErrAccountSuspended {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginOIDC, UserID: &user.ID, Account: user.UserID,
+				Outcome: models.AuditFailure, Reason: "suspended"})
+		}
+		return tokensNotIssued(c, err)
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginOIDC, UserID: &user.ID, Account: user.UserID,
+		Outcome: models.AuditSuccess, Reason: provider})
+
+	return c.JSON(http.StatusOK, tokenResponse(user, tokens))
+}
+
+// ListIdentities returns the provider accounts linked to the authenticated user
+func (h *OIDCHandler) ListIdentities(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	identities, err := h.oidcService.ListIdentities(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get linked accounts"})
+	}
+
+	return c.JSON(http.StatusOK, identities)
+}
+
+// UnlinkIdentity removes one of the authenticated user's linked provider accounts
+func (h *OIDCHandler) UnlinkIdentity(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	identityID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid linked account ID"})
+	}
+
+	if err := h.oidcService.UnlinkIdentity(userUUID, identityID); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Linked account not found"})
+		case service.ErrLastLoginMethod:
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Set a password or link another account before removing this one"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to unlink account"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditOIDCUnlink, UserID: &userUUID,
+		Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account unlinked"})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+func newTestOIDCHandler(t *testing.T) *OIDCHandler {
+	t.Helper()
+
+	// Nothing listens here, so a callback that gets past the state cookie
+	// check fails when the state is looked up
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := &config.Config{OIDCProviders: []config.OIDCProvider{{
+		Name:     "mock",
+		Issuer:   "http://127.0.0.1:1",
+		ClientID: "mock-client",
+	}}}
+	oidcService := service.NewOIDCService(cfg, http.DefaultClient, repository.NewOIDCRepository(db), repository.NewUserRepository(db))
+	audit := service.NewAuditRecorder(repository.NewAuditRepository(db))
+	return NewOIDCHandler(oidcService, nil, nil, audit)
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	handler := newTestOIDCHandler(t)
+	e := echo.New()
+
+	tests := []struct {
+		name       string
+		cookie     *http.Cookie
+		wantStatus int
+	}{
+		{name: "no cookie", wantStatus: http.StatusBadRequest},
+		{name: "other state", cookie: &http.Cookie{Name: oidcStateCookie, Value: "attacker-state"}, wantStatus: http.StatusBadRequest},
+		{name: "matching state", cookie: &http.Cookie{Name: oidcStateCookie, Value: "victim-state"}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/oidc/mock/callback", strings.NewReader(`{"code":"code","state":"victim-state"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("provider")
+			c.SetParamValues("mock")
+
+			if err := handler.Callback(c); err != nil {
+				t.Fatalf("Callback: %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
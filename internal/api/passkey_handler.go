@@ -0,0 +1,332 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/auth"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+type PasskeyHandler struct {
+	userRepo       *repository.UserRepository
+	passkeyRepo    *repository.PasskeyRepository
+	passkeyService *service.PasskeyService
+	tokenService   *service.TokenService
+	guard          *service.BruteForceGuard
+	audit          *service.AuditRecorder
+}
+
+func NewPasskeyHandler(
+	userRepo *repository.UserRepository,
+	passkeyRepo *repository.PasskeyRepository,
+	passkeyService *service.PasskeyService,
+	tokenService *service.TokenService,
+	guard *service.BruteForceGuard,
+	audit *service.AuditRecorder,
+) *PasskeyHandler {
+	return &PasskeyHandler{
+		userRepo:       userRepo,
+		passkeyRepo:    passkeyRepo,
+		passkeyService: passkeyService,
+		tokenService:   tokenService,
+		guard:          guard,
+		audit:          audit,
+	}
+}
+
+// BeginRegistration starts adding a passkey to the authenticated user's account
+func (h *PasskeyHandler) BeginRegistration(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	passkeyUser, err := h.loadPasskeyUser(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	options, challenge, err := h.passkeyService.BeginRegistration(passkeyUser)
+	if err != nil {
+		c.Logger().Errorf("Failed to begin passkey registration: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start passkey registration"})
+	}
+
+	if err := h.passkeyRepo.CreateChallenge(challenge); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store challenge"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"challenge_id": challenge.ID,
+		"options":      options,
+	})
+}
+
+// FinishRegistration verifies the authenticator response and stores the new passkey
+func (h *PasskeyHandler) FinishRegistration(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		ChallengeID uuid.UUID       `json:"challenge_id" validate:"required"`
+		DeviceName  *string         `json:"device_name"`
+		Credential  json.RawMessage `json:"credential" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	challenge, err := h.passkeyRepo.ConsumeChallenge(req.ChallengeID, models.ChallengeTypeRegistration)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired challenge"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify challenge"})
+	}
+
+	if challenge.UserID == nil || *challenge.UserID != userUUID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired challenge"})
+	}
+
+	passkeyUser, err := h.loadPasskeyUser(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve user"})
+	}
+
+	credential, err := h.passkeyService.FinishRegistration(passkeyUser, challenge, req.Credential)
+	if err != nil {
+		c.Logger().Warnf("Passkey registration failed: %v", err)
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasskeyRegister, UserID: &userUUID,
+			Outcome: models.AuditFailure, Reason: "verification_failed"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Passkey verification failed"})
+	}
+	credential.DeviceName = req.DeviceName
+
+	if err := h.passkeyRepo.CreateCredential(credential); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store passkey"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasskeyRegister, UserID: &userUUID,
+		Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusCreated, credential)
+}
+
+// BeginLogin starts a passkey login. The browser is asked for a discoverable
+// credential, so the response is the same whether or not an account exists.
+func (h *PasskeyHandler) BeginLogin(c echo.Context) error {
+	options, challenge, err := h.passkeyService.BeginLogin()
+	if err != nil {
+		c.Logger().Errorf("Failed to begin passkey login: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start passkey login"})
+	}
+
+	if err := h.passkeyRepo.CreateChallenge(challenge); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store challenge"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"challenge_id": challenge.ID,
+		"options":      options,
+	})
+}
+
+// FinishLogin verifies the assertion and issues the same tokens as password login
+func (h *PasskeyHandler) FinishLogin(c echo.Context) error {
+	var req struct {
+		ChallengeID uuid.UUID       `json:"challenge_id" validate:"required"`
+		Credential  json.RawMessage `json:"credential" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	challenge, err := h.passkeyRepo.ConsumeChallenge(req.ChallengeID, models.ChallengeTypeAuthentication)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired challenge"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify challenge"})
+	}
+
+	// Remember which account the credential belongs to, even if the assertion fails
+	var resolved *models.User
+	lookup := func(credentialID string, userHandle []byte) (*service.PasskeyUser, error) {
+		passkeyUser, err := h.lookupDiscoverable(credentialID, userHandle)
+		if err == nil {
+			resolved = passkeyUser.User
+		}
+		return passkeyUser, err
+	}
+
+	passkeyUser, credential, err := h.passkeyService.FinishLogin(lookup, challenge, req.Credential)
+	if err != nil {
+		c.Logger().Warnf("Passkey login failed: %v", err)
+		if resolved == nil {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginPasskey,
+				Outcome: models.AuditFailure, Reason: "unknown_credential"})
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Passkey authentication failed"})
+		}
+		return h.loginFailed(c, resolved, "verification_failed")
+	}
+	user := passkeyUser.User
+
+	// Reject logins while the account is locked out, as password logins are
+	lockout, err := h.guard.CheckAccount(user.UserID, &user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check login attempts"})
+	}
+	if lockout > 0 {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginPasskey, UserID: &user.ID, Account: user.UserID,
+			Outcome: models.AuditFailure, Reason: "locked_out"})
+		return auth.TooManyRequests(c, lockout)
+	}
+
+	if credential.Authenticator.CloneWarning {
+		c.Logger().Warnf("Passkey sign counter did not increase for user %s", user.ID)
+		return h.loginFailed(c, user, "clone_warning")
+	}
+
+	// Accounts past their deletion grace period are waiting to be purged
+	if user.DeletionScheduledFor != nil && !user.DeletionScheduledFor.After(time.Now()) {
+		recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginPasskey, UserID: &user.ID, Account: user.UserID,
+			Outcome: models.AuditFailure, Reason: "pending_deletion"})
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Passkey authentication failed"})
+	}
+
+	credentialID := service.EncodeCredentialID(credential.ID)
+	if err := h.passkeyRepo.UpdateCredentialUsage(credentialID, credential.Authenticator.SignCount, credential.Flags.BackupState); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update passkey"})
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := h.tokenService.IssueTokens(user, clientInfo(c))
+	if err != nil {
+		if err == service.ErrAccountSuspended {
+			recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginPasskey, UserID: &user.ID, Account: user.UserID,
+				Outcome: models.AuditFailure, Reason: "suspended"})
+		}
+		return tokensNotIssued(c, err)
+	}
+
+	if err := h.guard.RecordSuccess(user.UserID, &user.ID); err != nil {
+		c.Logger().Errorf("Failed to reset login attempts: %v", err)
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginPasskey, UserID: &user.ID, Account: user.UserID,
+		Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, tokenResponse(user, tokens))
+}
+
+// loginFailed counts a failed passkey login towards the account's lockout
+func (h *PasskeyHandler) loginFailed(c echo.Context, user *models.User, reason string) error {
+	if _, err := h.guard.RecordFailure(user.UserID, &user.ID); err != nil {
+		c.Logger().Errorf("Failed to record login attempt: %v", err)
+	}
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditLoginPasskey, UserID: &user.ID, Account: user.UserID,
+		Outcome: models.AuditFailure, Reason: reason})
+	return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Passkey authentication failed"})
+}
+
+// ListCredentials returns the authenticated user's passkeys
+func (h *PasskeyHandler) ListCredentials(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	credentials, err := h.passkeyRepo.GetCredentialsByUserID(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get passkeys"})
+	}
+
+	return c.JSON(http.StatusOK, credentials)
+}
+
+// RenameCredential changes the friendly name of one of the user's passkeys
+func (h *PasskeyHandler) RenameCredential(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		DeviceName string `json:"device_name" validate:"required"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.DeviceName == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	if err := h.passkeyRepo.RenameCredential(userUUID, c.Param("id"), req.DeviceName); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Passkey not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to rename passkey"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Passkey renamed successfully"})
+}
+
+// DeleteCredential removes one of the user's passkeys
+func (h *PasskeyHandler) DeleteCredential(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	if err := h.passkeyRepo.DeleteCredential(userUUID, c.Param("id")); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Passkey not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete passkey"})
+	}
+
+	recordAudit(c, h.audit, service.AuditEntry{EventType: models.AuditPasskeyDelete, UserID: &userUUID,
+		Outcome: models.AuditSuccess})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Passkey deleted successfully"})
+}
+
+func (h *PasskeyHandler) loadPasskeyUser(userID uuid.UUID) (*service.PasskeyUser, error) {
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := h.passkeyRepo.GetCredentialsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &service.PasskeyUser{User: user, Credentials: credentials}, nil
+}
+
+// lookupDiscoverable resolves the account for a discoverable login and checks the
+// credential actually belongs to the user handle the authenticator returned
+func (h *PasskeyHandler) lookupDiscoverable(credentialID string, userHandle []byte) (*service.PasskeyUser, error) {
+	credential, err := h.passkeyRepo.GetCredentialByID(credentialID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(credential.UserID[:], userHandle) {
+		return nil, errors.New("credential does not belong to user handle")
+	}
+
+	return h.loadPasskeyUser(credential.UserID)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+const personalAccessTokenNameMaxLength = 100
+
+type PersonalAccessTokenHandler struct {
+	patService *service.PersonalAccessTokenService
+}
+
+func NewPersonalAccessTokenHandler(patService *service.PersonalAccessTokenService) *PersonalAccessTokenHandler {
+	return &PersonalAccessTokenHandler{patService: patService}
+}
+
+// CreateToken issues a personal access token. The token is only shown in this response.
+func (h *PersonalAccessTokenHandler) CreateToken(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var req struct {
+		Name      string     `json:"name" validate:"required,max=100"`
+		Scopes    []string   `json:"scopes" validate:"required"`
+		ExpiresAt *time.Time `json:"expires_at"` // Never expires when omitted
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > personalAccessTokenNameMaxLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name must be between 1 and 100 characters"})
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Expiry must be in the future"})
+	}
+
+	token, raw, err := h.patService.Create(userUUID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidScope) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create token"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"token":                 raw,
+		"personal_access_token": token,
+	})
+}
+
+// ListTokens returns the current user's personal access tokens without their values
+func (h *PersonalAccessTokenHandler) ListTokens(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	tokens, err := h.patService.List(userUUID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get tokens"})
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// RevokeToken deletes one of the current user's personal access tokens
+func (h *PersonalAccessTokenHandler) RevokeToken(c echo.Context) error {
+	userUUID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	tokenID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid token ID"})
+	}
+
+	if err := h.patService.Revoke(userUUID, tokenID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Token not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke token"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Token revoked"})
+}
@@ -1,20 +1,39 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/auth"
 	"github.com/toof-jp/shisha-log-backend/internal/models"
 	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+// maxGrams bounds bowl and flavor weights
+const maxGrams = 1000
+
+const mixPercentagesMessage = "Flavor percentages must be set on every flavor and add up to 100"
+
+const (
+	sessionDefaultLimit = 20
+	sessionMaxLimit     = 200
 )
 
 type SessionHandler struct {
-	repo *repository.SessionRepository
+	repo  *repository.SessionRepository
+	timer *service.SessionTimerService
 }
 
-func NewSessionHandler(repo *repository.SessionRepository) *SessionHandler {
-	return &SessionHandler{repo: repo}
+func NewSessionHandler(repo *repository.SessionRepository, timer *service.SessionTimerService) *SessionHandler {
+	return &SessionHandler{
+		repo:  repo,
+		timer: timer,
+	}
 }
 
 func (h *SessionHandler) CreateSession(c echo.Context) error {
@@ -30,18 +49,35 @@ func (h *SessionHandler) CreateSession(c echo.Context) error {
 		return c.JSON(http.StatusForbidden, map[string]string{"error": "Cannot create sessions for other users"})
 	}
 
+	if req.BowlWeightGrams != nil {
+		if err := validateGrams("Bowl weight", *req.BowlWeightGrams); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+	if err := validateFlavors(req.Flavors); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := validateRatings(req.SessionRatings, false); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
 	session := &models.ShishaSession{
-		UserID:       req.UserID,
-		CreatedBy:    userID,
-		SessionDate:  req.SessionDate,
-		StoreName:    req.StoreName,
-		Notes:        req.Notes,
-		OrderDetails: req.OrderDetails,
-		MixName:      req.MixName,
+		UserID:          req.UserID,
+		CreatedBy:       userID,
+		SessionDate:     req.SessionDate,
+		StoreName:       req.StoreName,
+		Notes:           req.Notes,
+		OrderDetails:    req.OrderDetails,
+		MixName:         req.MixName,
+		BowlWeightGrams: req.BowlWeightGrams,
+		SessionRatings:  req.SessionRatings,
 	}
 
 	createdSession, err := h.repo.Create(c.Request().Context(), session, req.Flavors)
 	if err != nil {
+		if err == models.ErrMixPercentages {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": mixPercentagesMessage})
+		}
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create session"})
 	}
 
@@ -49,20 +85,9 @@ func (h *SessionHandler) CreateSession(c echo.Context) error {
 }
 
 func (h *SessionHandler) GetSession(c echo.Context) error {
-	sessionID := c.Param("id")
-	userID := c.Get("user_id").(string)
-
-	session, err := h.repo.GetByID(c.Request().Context(), sessionID)
-	if err != nil {
-		if err.Error() == "session not found" {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
-		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get session"})
-	}
-
-	// Check if user has access to this session
-	if session.UserID != userID {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+	session, err := h.accessibleSession(c, models.PermissionSessionsReadAny)
+	if session == nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, session)
@@ -75,11 +100,53 @@ func (h *SessionHandler) GetUserSessions(c echo.Context) error {
 	limit, _ := strconv.Atoi(c.QueryParam("limit"))
 	offset, _ := strconv.Atoi(c.QueryParam("offset"))
 
-	if limit == 0 {
-		limit = 20
+	if limit <= 0 {
+		limit = sessionDefaultLimit
+	}
+	if limit > sessionMaxLimit {
+		limit = sessionMaxLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	filter := models.SessionFilter{
+		UserID:     userID,
+		MinRatings: map[string]int{},
+		MaxRatings: map[string]int{},
+		Sort:       models.SessionSortDate,
+		Limit:      limit,
+		Offset:     offset,
+	}
+
+	// min_<rating> and max_<rating> for every rating, e.g. min_taste_rating
+	for _, field := range models.SessionRatingFields {
+		for prefix, target := range map[string]map[string]int{"min_": filter.MinRatings, "max_": filter.MaxRatings} {
+			param := prefix + field
+			if value := c.QueryParam(param); value != "" {
+				rating, err := strconv.Atoi(value)
+				if err != nil || rating < models.MinRating || rating > models.MaxRating {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid %s, use %d to %d", param, models.MinRating, models.MaxRating)})
+				}
+				target[field] = rating
+			}
+		}
+	}
+	if sort := c.QueryParam("sort"); sort != "" {
+		if !models.IsValidSessionSort(sort) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid sort"})
+		}
+		filter.Sort = sort
+	}
+	switch c.QueryParam("order") {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid order, use asc or desc"})
 	}
 
-	sessions, err := h.repo.GetByUserID(c.Request().Context(), userID, limit, offset)
+	sessions, err := h.repo.Search(c.Request().Context(), filter)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get sessions"})
 	}
@@ -88,54 +155,334 @@ func (h *SessionHandler) GetUserSessions(c echo.Context) error {
 }
 
 func (h *SessionHandler) UpdateSession(c echo.Context) error {
-	sessionID := c.Param("id")
-	userID := c.Get("user_id").(string)
+	session, err := h.accessibleSession(c, models.PermissionSessionsWriteAny)
+	if session == nil {
+		return err
+	}
+
+	var req models.UpdateSessionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	// A bowl weight of 0 removes it
+	if req.BowlWeightGrams != nil && *req.BowlWeightGrams != 0 {
+		if err := validateGrams("Bowl weight", *req.BowlWeightGrams); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+	if req.Flavors != nil {
+		if err := validateFlavors(*req.Flavors); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+	if err := validateRatings(req.SessionRatings, true); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if err := h.repo.Update(c.Request().Context(), session.ID, &req); err != nil {
+		if err == models.ErrMixPercentages {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": mixPercentagesMessage})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update session"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session updated successfully"})
+}
+
+func (h *SessionHandler) DeleteSession(c echo.Context) error {
+	session, err := h.accessibleSession(c, models.PermissionSessionsWriteAny)
+	if session == nil {
+		return err
+	}
+
+	if err := h.repo.Delete(c.Request().Context(), session.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete session"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session deleted successfully"})
+}
+
+// GetActiveSession returns the current user's running session
+func (h *SessionHandler) GetActiveSession(c echo.Context) error {
+	session, err := h.timer.Active(c.Request().Context(), c.Get("user_id").(string))
+	if err != nil {
+		if err == repository.ErrSessionNotFound {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No active session"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get active session"})
+	}
+
+	return c.JSON(http.StatusOK, session)
+}
+
+// StartSession starts timing a session. Its owner can only have one session
+// running at a time.
+func (h *SessionHandler) StartSession(c echo.Context) error {
+	session, err := h.accessibleSession(c, models.PermissionSessionsWriteAny)
+	if session == nil {
+		return err
+	}
+
+	if err := h.timer.Start(c.Request().Context(), session.ID, session.UserID); err != nil {
+		switch err {
+		case repository.ErrSessionStarted:
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Session already started"})
+		case repository.ErrOtherSessionRunning:
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Another session is already running"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start session"})
+	}
+
+	return h.respondWithSession(c, session.ID)
+}
+
+// StopSession stops timing a running session
+func (h *SessionHandler) StopSession(c echo.Context) error {
+	session, err := h.accessibleSession(c, models.PermissionSessionsWriteAny)
+	if session == nil {
+		return err
+	}
+
+	if err := h.timer.Stop(c.Request().Context(), session.ID); err != nil {
+		if err == repository.ErrSessionNotRunning {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Session is not running"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to stop session"})
+	}
+
+	return h.respondWithSession(c, session.ID)
+}
 
-	// Check ownership
+// respondWithSession returns the session as it is now
+func (h *SessionHandler) respondWithSession(c echo.Context, sessionID string) error {
 	session, err := h.repo.GetByID(c.Request().Context(), sessionID)
 	if err != nil {
-		if err.Error() == "session not found" {
+		if err == repository.ErrSessionNotFound {
 			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
 		}
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get session"})
 	}
 
-	if session.UserID != userID {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+	return c.JSON(http.StatusOK, session)
+}
+
+// GetFlavorStats returns the current user's ratings averaged per flavor
+func (h *SessionHandler) GetFlavorStats(c echo.Context) error {
+	stats, err := h.repo.FlavorStats(c.Request().Context(), c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get flavor stats"})
 	}
 
-	var req models.UpdateSessionRequest
+	return c.JSON(http.StatusOK, stats)
+}
+
+// GetMixStats returns the current user's ratings averaged per flavor combination
+func (h *SessionHandler) GetMixStats(c echo.Context) error {
+	stats, err := h.repo.MixStats(c.Request().Context(), c.Get("user_id").(string))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get mix stats"})
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// AddFlavor adds a flavor to a session, at the end unless a position is given
+func (h *SessionHandler) AddFlavor(c echo.Context) error {
+	session, err := h.accessibleSession(c, models.PermissionSessionsWriteAny)
+	if session == nil {
+		return err
+	}
+
+	var req models.AddFlavorRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	if err := h.repo.Update(c.Request().Context(), sessionID, &req); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update session"})
+	if err := validateFlavor(req.FlavorName, req.Percentage, req.Grams); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := validatePercentages(req.Percentages); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if req.Position != nil && *req.Position < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Position must not be negative"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Session updated successfully"})
+	flavor, err := h.repo.AddFlavor(c.Request().Context(), session.ID, &req)
+	if err != nil {
+		switch err {
+		case repository.ErrSessionNotFound:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		case repository.ErrFlavorNotFound:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Percentages name a flavor that is not in the session"})
+		case models.ErrMixPercentages:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": mixPercentagesMessage})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add flavor"})
+	}
+
+	return c.JSON(http.StatusCreated, flavor)
 }
 
-func (h *SessionHandler) DeleteSession(c echo.Context) error {
-	sessionID := c.Param("id")
-	userID := c.Get("user_id").(string)
+// UpdateFlavor renames a flavor, changes its brand or moves it
+func (h *SessionHandler) UpdateFlavor(c echo.Context) error {
+	session, err := h.accessibleSession(c, models.PermissionSessionsWriteAny)
+	if session == nil {
+		return err
+	}
 
-	// Check ownership
-	session, err := h.repo.GetByID(c.Request().Context(), sessionID)
+	var req models.UpdateFlavorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	if req.FlavorName != nil && strings.TrimSpace(*req.FlavorName) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Flavor name is required"})
+	}
+	// A percentage or grams of 0 removes it
+	if req.Percentage != nil && *req.Percentage != 0 {
+		if err := validatePercentage(*req.Percentage); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+	if err := validatePercentages(req.Percentages); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if req.Grams != nil && *req.Grams != 0 {
+		if err := validateGrams("Grams", *req.Grams); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+	if req.Position != nil && *req.Position < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Position must not be negative"})
+	}
+
+	flavor, err := h.repo.UpdateFlavor(c.Request().Context(), session.ID, c.Param("flavorId"), &req)
 	if err != nil {
-		if err.Error() == "session not found" {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		switch err {
+		case repository.ErrSessionNotFound, repository.ErrFlavorNotFound:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Flavor not found"})
+		case models.ErrMixPercentages:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": mixPercentagesMessage})
 		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get session"})
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update flavor"})
 	}
 
-	if session.UserID != userID {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+	return c.JSON(http.StatusOK, flavor)
+}
+
+// DeleteFlavor removes a flavor from a session
+func (h *SessionHandler) DeleteFlavor(c echo.Context) error {
+	session, err := h.accessibleSession(c, models.PermissionSessionsWriteAny)
+	if session == nil {
+		return err
 	}
 
-	if err := h.repo.Delete(c.Request().Context(), sessionID); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete session"})
+	if err := h.repo.DeleteFlavor(c.Request().Context(), session.ID, c.Param("flavorId")); err != nil {
+		switch err {
+		case repository.ErrSessionNotFound, repository.ErrFlavorNotFound:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Flavor not found"})
+		case models.ErrMixPercentages:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": mixPercentagesMessage})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete flavor"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Session deleted successfully"})
+	return c.JSON(http.StatusOK, map[string]string{"message": "Flavor deleted successfully"})
+}
+
+// accessibleSession loads the session named in the path and checks the user
+// owns it or has anyPermission. If not, it responds and returns a nil session
+// with the result of writing the response.
+func (h *SessionHandler) accessibleSession(c echo.Context, anyPermission string) (*models.SessionWithFlavors, error) {
+	session, err := h.repo.GetByID(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		if err == repository.ErrSessionNotFound {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		}
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get session"})
+	}
+
+	if !auth.CanAccess(c, session.UserID, anyPermission) {
+		return nil, c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+	}
+
+	return session, nil
+}
+
+// validateFlavors checks the flavors given for a new or replaced flavor list.
+// Whether their percentages add up is checked when they are stored.
+func validateFlavors(flavors []models.CreateFlavorRequest) error {
+	for _, flavor := range flavors {
+		if err := validateFlavor(flavor.FlavorName, flavor.Percentage, flavor.Grams); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateFlavor(flavorName string, percentage, grams *float64) error {
+	if strings.TrimSpace(flavorName) == "" {
+		return errors.New("Flavor name is required")
+	}
+	if percentage != nil {
+		if err := validatePercentage(*percentage); err != nil {
+			return err
+		}
+	}
+	if grams != nil {
+		if err := validateGrams("Grams", *grams); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePercentage(percentage float64) error {
+	if percentage <= 0 || percentage > 100 {
+		return errors.New("Percentage must be more than 0 and at most 100")
+	}
+	return nil
+}
+
+// validatePercentages checks the percentages a flavor edit sets on other flavors
+func validatePercentages(percentages map[string]float64) error {
+	for _, percentage := range percentages {
+		if err := validatePercentage(percentage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateGrams(field string, grams float64) error {
+	if grams <= 0 || grams > maxGrams {
+		return fmt.Errorf("%s must be more than 0 and at most %d grams", field, maxGrams)
+	}
+	return nil
+}
+
+// validateRatings checks that ratings are within range. With allowZero, 0 is
+// accepted as well, for updates that remove a rating.
+func validateRatings(ratings models.SessionRatings, allowZero bool) error {
+	for _, rating := range []struct {
+		name  string
+		value *int
+	}{
+		{"Rating", ratings.Rating},
+		{"Taste rating", ratings.TasteRating},
+		{"Smoke volume rating", ratings.SmokeVolumeRating},
+		{"Harshness rating", ratings.HarshnessRating},
+		{"Heat stability rating", ratings.HeatStabilityRating},
+		{"Longevity rating", ratings.LongevityRating},
+	} {
+		if rating.value == nil || (allowZero && *rating.value == 0) {
+			continue
+		}
+		if *rating.value < models.MinRating || *rating.value > models.MaxRating {
+			return fmt.Errorf("%s must be from %d to %d", rating.name, models.MinRating, models.MaxRating)
+		}
+	}
+	return nil
 }
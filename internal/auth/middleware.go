@@ -1,20 +1,37 @@
 package auth
 
 import (
+	"database/sql"
 	"net/http"
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
 	"github.com/toof-jp/shisha-log-backend/internal/service"
 )
 
 type AuthMiddleware struct {
-	jwtService *service.JWTService
+	jwtService      *service.JWTService
+	revocationStore service.RevocationStore
+	userRepo        *repository.UserRepository
+	deviceTracker   *service.DeviceTracker
+	patService      *service.PersonalAccessTokenService
 }
 
-func NewAuthMiddleware(jwtService *service.JWTService) *AuthMiddleware {
+func NewAuthMiddleware(
+	jwtService *service.JWTService,
+	revocationStore service.RevocationStore,
+	userRepo *repository.UserRepository,
+	deviceTracker *service.DeviceTracker,
+	patService *service.PersonalAccessTokenService,
+) *AuthMiddleware {
 	return &AuthMiddleware{
-		jwtService: jwtService,
+		jwtService:      jwtService,
+		revocationStore: revocationStore,
+		userRepo:        userRepo,
+		deviceTracker:   deviceTracker,
+		patService:      patService,
 	}
 }
 
@@ -30,16 +47,99 @@ func (m *AuthMiddleware) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authorization header format"})
 		}
 
+		// Scripts and integrations authenticate with personal access tokens
+		if service.IsPersonalAccessToken(tokenString) {
+			token, err := m.patService.Authenticate(tokenString)
+			if err != nil {
+				if err == service.ErrInvalidPersonalAccessToken {
+					return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired token"})
+				}
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify token"})
+			}
+
+			status, err := m.userRepo.GetAuthStatus(token.UserID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired token"})
+				}
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify token"})
+			}
+			if status.Suspended {
+				return accountSuspended(c)
+			}
+			// Only the owner can cancel a deletion, by logging in
+			if status.DeletionScheduled {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired token"})
+			}
+
+			c.Set("user_id", token.UserID.String())
+			c.Set("role", status.Role)
+			c.Set("personal_access_token", token)
+
+			return next(c)
+		}
+
 		// Validate token using JWT service
 		claims, err := m.jwtService.ValidateToken(tokenString)
 		if err != nil {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired token"})
 		}
 
-		// Set user ID and username in context
+		// Reject tokens revoked by logout before they expire
+		revoked, err := m.revocationStore.IsRevoked(claims.ID, claims.UserID, claims.IssuedAt.Time)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify token"})
+		}
+		if revoked {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Token has been revoked"})
+		}
+
+		// Reject tokens issued before the last password change or reset
+		status, err := m.userRepo.GetAuthStatus(claims.UserID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired token"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify token"})
+		}
+		if claims.TokenVersion != status.TokenVersion {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Token is no longer valid, please log in again"})
+		}
+
+		if status.Suspended {
+			return accountSuspended(c)
+		}
+
+		// Reject tokens of devices that were signed out, and record activity
+		if claims.SessionID != "" {
+			deviceID, err := uuid.Parse(claims.SessionID)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired token"})
+			}
+
+			active, err := m.deviceTracker.Seen(deviceID, c.RealIP())
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify token"})
+			}
+			if !active {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Token has been revoked"})
+			}
+		}
+
+		// Set user ID, username and role in context. The role is read from the
+		// database so a role change applies to tokens already issued.
 		c.Set("user_id", claims.UserID.String())
 		c.Set("username", claims.Username)
+		c.Set("role", status.Role)
+		c.Set("token_id", claims.ID)
+		c.Set("token_expires_at", claims.ExpiresAt.Time)
+		c.Set("session_id", claims.SessionID)
 
 		return next(c)
 	}
 }
+
+// accountSuspended rejects requests of suspended users
+func accountSuspended(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, map[string]string{"error": "Account suspended"})
+}
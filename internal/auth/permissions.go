@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+// Role returns the role of the authenticated user
+func Role(c echo.Context) string {
+	if role, ok := c.Get("role").(string); ok && role != "" {
+		return role
+	}
+	return models.RoleUser
+}
+
+// HasPermission reports whether the authenticated request may use permission.
+// Personal access tokens are also limited to their scopes.
+func HasPermission(c echo.Context, permission string) bool {
+	if !models.RoleHasPermission(Role(c), permission) {
+		return false
+	}
+	if token, ok := c.Get("personal_access_token").(*models.PersonalAccessToken); ok {
+		return token.HasScope(permission)
+	}
+	return true
+}
+
+// CanAccess reports whether the authenticated user owns a resource, or may act
+// on everyone's with anyPermission. Use it in handlers once the owner is known.
+func CanAccess(c echo.Context, ownerID string, anyPermission string) bool {
+	if userID, _ := c.Get("user_id").(string); userID != "" && userID == ownerID {
+		return true
+	}
+	return HasPermission(c, anyPermission)
+}
+
+// RequirePermission rejects requests that don't have permission. Every
+// authenticated route declares the permission it needs with it. It must run
+// after Authenticate.
+func RequirePermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if HasPermission(c, permission) {
+				return next(c)
+			}
+
+			if _, ok := c.Get("personal_access_token").(*models.PersonalAccessToken); ok && models.RoleHasPermission(Role(c), permission) {
+				if !isTokenScope(permission) {
+					return c.JSON(http.StatusForbidden, map[string]string{"error": "Personal access tokens cannot be used here"})
+				}
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Token is missing the " + permission + " scope"})
+			}
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+		}
+	}
+}
+
+// RequireRole only lets users with one of the roles through. It must run after
+// Authenticate.
+func RequireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			role := Role(c)
+			for _, allowed := range roles {
+				if role == allowed {
+					return next(c)
+				}
+			}
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+		}
+	}
+}
+
+func isTokenScope(permission string) bool {
+	for _, scope := range models.PersonalAccessTokenScopes {
+		if scope == permission {
+			return true
+		}
+	}
+	return false
+}
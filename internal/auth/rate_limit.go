@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+// RateLimiter throttles requests per client IP using fixed windows
+type RateLimiter struct {
+	store  service.AttemptStore
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+func NewRateLimiter(store service.AttemptStore, prefix string, limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		store:  store,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (l *RateLimiter) Limit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		record, err := l.store.Hit("ip:"+l.prefix+":"+c.RealIP(), l.window)
+		if err != nil {
+			c.Logger().Errorf("Rate limiter unavailable: %v", err)
+			return next(c)
+		}
+
+		if record.Count > l.limit {
+			return TooManyRequests(c, time.Until(record.WindowStart.Add(l.window)))
+		}
+
+		return next(c)
+	}
+}
+
+// TooManyRequests responds with 429 and a Retry-After header in whole seconds
+func TooManyRequests(c echo.Context, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+		"error":       "Too many attempts, please try again later",
+		"retry_after": seconds,
+	})
+}
@@ -3,21 +3,76 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Port                string
-	Environment         string
-	SupabaseURL         string
-	SupabaseAnonKey     string
-	SupabaseServiceRole string
-	JWTSecret           string
-	AllowedOrigins      []string
-	DatabaseURL         string
-	TokenDuration       string
+	Port                    string
+	Environment             string
+	SupabaseURL             string
+	SupabaseAnonKey         string
+	SupabaseServiceRole     string
+	JWTSecret               string
+	JWTSigningKeyFile       string
+	JWTVerificationKeyFiles []string
+	JWTAcceptHS256          bool // keep accepting JWT_SECRET tokens after switching to a signing key
+	AllowedOrigins          []string
+	DatabaseURL             string
+	TokenDuration           string
+	RefreshTokenDuration    string
+	RevocationStore         string
+	WebAuthnRPID            string
+	WebAuthnRPName          string
+	WebAuthnRPOrigins       []string
+	AttemptStore            string
+	LoginMaxFailures        int
+	LoginLockoutBase        string
+	LoginLockoutMax         string
+	AuthRateLimit           int // requests per minute per IP on public auth routes
+	MFAEncryptionKey        string
+	Argon2Memory            int // KiB
+	Argon2Iterations        int
+	Argon2Parallelism       int
+	PasswordMinLength       int
+	PasswordMinEntropy      int    // estimated bits
+	Notifier                string // log or smtp
+	SMTPHost                string
+	SMTPPort                string
+	SMTPUsername            string
+	SMTPPassword            string
+	SMTPFrom                string
+	AppBaseURL              string // frontend URL used in links sent to users
+	TokenCleanupInterval    string
+	AccountDeletionGrace    string // how long a deleted account can still be restored
+	AccountPurgeInterval    string
+	UserIDChangeCooldown    string // minimum time between two user ID changes
+	UserIDHoldPeriod        string // how long a released user ID stays reserved for its previous owner
+	SessionMaxDuration      string // live sessions running longer are stopped automatically
+	SessionAutoStopInterval string
+	OIDCProviders           []OIDCProvider
+}
+
+// OIDCProvider is an OpenID Connect provider users can log in with
+type OIDCProvider struct {
+	Name         string // used in URLs, e.g. "google"
+	Issuer       string // discovery document is read from Issuer + "/.well-known/openid-configuration"
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string // where the provider sends the user back with the authorization code
+	HS256        bool   // ID tokens may be signed with the client secret
+}
+
+// knownOIDCProviders are enabled by setting OIDC_<NAME>_CLIENT_ID
+var knownOIDCProviders = []OIDCProvider{
+	{Name: "google", Issuer: "https://accounts.google.com", Scopes: []string{"openid", "email", "profile"}},
+	// Apple only allows the query response mode when no scopes beyond openid are requested
+	{Name: "apple", Issuer: "https://appleid.apple.com", Scopes: []string{"openid"}},
+	// LINE signs ID tokens from channels without a key pair with the channel secret
+	{Name: "line", Issuer: "https://access.line.me", Scopes: []string{"openid", "profile"}, HS256: true},
 }
 
 func LoadConfig() (*Config, error) {
@@ -26,19 +81,74 @@ func LoadConfig() (*Config, error) {
 	}
 
 	config := &Config{
-		Port:                getEnv("PORT", "8080"),
-		Environment:         getEnv("ENVIRONMENT", "development"),
-		SupabaseURL:         getEnv("SUPABASE_URL", ""),
-		SupabaseAnonKey:     getEnv("SUPABASE_ANON_KEY", ""),
-		SupabaseServiceRole: getEnv("SUPABASE_SERVICE_ROLE_KEY", ""),
-		JWTSecret:           getEnv("JWT_SECRET", ""),
-		DatabaseURL:         getEnv("DATABASE_URL", ""),
-		TokenDuration:       getEnv("TOKEN_DURATION", "24h"),
+		Port:                    getEnv("PORT", "8080"),
+		Environment:             getEnv("ENVIRONMENT", "development"),
+		SupabaseURL:             getEnv("SUPABASE_URL", ""),
+		SupabaseAnonKey:         getEnv("SUPABASE_ANON_KEY", ""),
+		SupabaseServiceRole:     getEnv("SUPABASE_SERVICE_ROLE_KEY", ""),
+		JWTSecret:               getEnv("JWT_SECRET", ""),
+		JWTSigningKeyFile:       getEnv("JWT_SIGNING_KEY_FILE", ""),
+		JWTAcceptHS256:          getEnv("JWT_ACCEPT_HS256", "false") == "true",
+		DatabaseURL:             getEnv("DATABASE_URL", ""),
+		TokenDuration:           getEnv("TOKEN_DURATION", "15m"),
+		RefreshTokenDuration:    getEnv("REFRESH_TOKEN_DURATION", "720h"),
+		RevocationStore:         getEnv("REVOCATION_STORE", "memory"),
+		WebAuthnRPID:            getEnv("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnRPName:          getEnv("WEBAUTHN_RP_NAME", "Shisha Log"),
+		AttemptStore:            getEnv("ATTEMPT_STORE", "memory"),
+		LoginMaxFailures:        getEnvInt("LOGIN_MAX_FAILURES", 5),
+		LoginLockoutBase:        getEnv("LOGIN_LOCKOUT_BASE", "1m"),
+		LoginLockoutMax:         getEnv("LOGIN_LOCKOUT_MAX", "1h"),
+		AuthRateLimit:           getEnvInt("AUTH_RATE_LIMIT", 20),
+		MFAEncryptionKey:        getEnv("MFA_ENCRYPTION_KEY", ""),
+		Argon2Memory:            getEnvInt("ARGON2_MEMORY_KIB", 19456),
+		Argon2Iterations:        getEnvInt("ARGON2_ITERATIONS", 2),
+		Argon2Parallelism:       getEnvInt("ARGON2_PARALLELISM", 1),
+		PasswordMinLength:       getEnvInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordMinEntropy:      getEnvInt("PASSWORD_MIN_ENTROPY", 35),
+		Notifier:                getEnv("NOTIFIER", "log"),
+		SMTPHost:                getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:                getEnv("SMTP_PORT", "1025"),
+		SMTPUsername:            getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:            getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:                getEnv("SMTP_FROM", "Shisha Log <no-reply@localhost>"),
+		TokenCleanupInterval:    getEnv("TOKEN_CLEANUP_INTERVAL", "1h"),
+		AccountDeletionGrace:    getEnv("ACCOUNT_DELETION_GRACE_PERIOD", "0s"),
+		AccountPurgeInterval:    getEnv("ACCOUNT_PURGE_INTERVAL", "15m"),
+		UserIDChangeCooldown:    getEnv("USER_ID_CHANGE_COOLDOWN", "720h"),
+		UserIDHoldPeriod:        getEnv("USER_ID_HOLD_PERIOD", "2160h"),
+		SessionMaxDuration:      getEnv("SESSION_MAX_DURATION", "6h"),
+		SessionAutoStopInterval: getEnv("SESSION_AUTO_STOP_INTERVAL", "5m"),
 	}
 
 	allowedOrigins := getEnv("ALLOWED_ORIGINS", "http://localhost:3000")
 	config.AllowedOrigins = strings.Split(allowedOrigins, ",")
 
+	// Links in emails point at the frontend, which is usually the first allowed origin
+	config.AppBaseURL = getEnv("APP_BASE_URL", config.AllowedOrigins[0])
+
+	// Retired signing keys stay here until every token they signed has expired
+	if files := getEnv("JWT_VERIFICATION_KEY_FILES", ""); files != "" {
+		config.JWTVerificationKeyFiles = strings.Split(files, ",")
+	}
+
+	// Passkeys are only valid for the origins the frontend is served from
+	webAuthnOrigins := getEnv("WEBAUTHN_RP_ORIGINS", allowedOrigins)
+	config.WebAuthnRPOrigins = strings.Split(webAuthnOrigins, ",")
+
+	// Social login providers. The issuer can be overridden, e.g. to point at a mock provider.
+	for _, provider := range knownOIDCProviders {
+		prefix := "OIDC_" + strings.ToUpper(provider.Name) + "_"
+		provider.ClientID = getEnv(prefix+"CLIENT_ID", "")
+		if provider.ClientID == "" {
+			continue
+		}
+		provider.ClientSecret = getEnv(prefix+"CLIENT_SECRET", "")
+		provider.Issuer = getEnv(prefix+"ISSUER", provider.Issuer)
+		provider.RedirectURL = getEnv(prefix+"REDIRECT_URL", config.AppBaseURL+"/auth/callback/"+provider.Name)
+		config.OIDCProviders = append(config.OIDCProviders, provider)
+	}
+
 	return config, nil
 }
 
@@ -48,3 +158,10 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
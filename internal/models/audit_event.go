@@ -0,0 +1,73 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Audit event types
+const (
+	AuditRegister             = "register"
+	AuditLogin                = "login"
+	AuditLoginMFA             = "login_mfa"
+	AuditRefresh              = "token_refresh"
+	AuditLogout               = "logout"
+	AuditLogoutAll            = "logout_all"
+	AuditPasswordChange       = "password_change"
+	AuditPasswordResetRequest = "password_reset_request"
+	AuditPasswordReset        = "password_reset"
+	AuditUserIDChange         = "user_id_change"
+	AuditEmailChange          = "email_change"
+
+	// Other ways to sign in and the second factor
+	AuditLoginPasskey            = "login_passkey"
+	AuditLoginOIDC               = "login_oidc"
+	AuditPasskeyRegister         = "passkey_register"
+	AuditPasskeyDelete           = "passkey_delete"
+	AuditOIDCLink                = "oidc_link"
+	AuditOIDCUnlink              = "oidc_unlink"
+	AuditMFAEnroll               = "mfa_enroll"
+	AuditMFAEnable               = "mfa_enable"
+	AuditMFADisable              = "mfa_disable"
+	AuditRecoveryCodesRegenerate = "mfa_recovery_codes_regenerate"
+
+	// Admin actions on another user, recorded with the admin as actor
+	AuditAdminUserView           = "admin_user_view"
+	AuditAdminSuspend            = "admin_suspend"
+	AuditAdminUnsuspend          = "admin_unsuspend"
+	AuditAdminForcePasswordReset = "admin_force_password_reset"
+	AuditAdminRevokeTokens       = "admin_revoke_tokens"
+)
+
+// Audit event outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEvent is an entry in the security audit log
+type AuditEvent struct {
+	ID        uuid.UUID  `json:"id"`
+	UserID    *uuid.UUID `json:"user_id"`
+	ActorID   *uuid.UUID `json:"actor_id,omitempty"` // Set when someone other than the user acted
+	Account   *string    `json:"account,omitempty"`  // User ID as entered at login
+	EventType string     `json:"event_type"`
+	Outcome   string     `json:"outcome"`
+	Reason    *string    `json:"reason,omitempty"`
+	IPAddress *string    `json:"ip_address"`
+	UserAgent *string    `json:"user_agent"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// AuditEventFilter narrows an audit log query. Zero values match everything.
+type AuditEventFilter struct {
+	UserID    *uuid.UUID
+	EventType string
+	Outcome   string
+	IPAddress string
+	Since     *time.Time
+	Until     *time.Time
+	Limit     int
+	Offset    int
+}
@@ -0,0 +1,12 @@
+package models
+
+import (
+	"time"
+)
+
+// AuthAttempt counts attempts for a rate limiting key within a fixed window
+type AuthAttempt struct {
+	Count       int       `json:"count"`
+	WindowStart time.Time `json:"window_start"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
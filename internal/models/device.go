@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuthDevice is a signed-in device, identified by its refresh token family
+type AuthDevice struct {
+	ID          uuid.UUID `json:"id"`
+	UserID      uuid.UUID `json:"user_id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   *string   `json:"user_agent"`
+	IPAddress   *string   `json:"ip_address"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"` // Set on the device making the request
+}
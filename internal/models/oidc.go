@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OIDCState is an authorization request waiting for the provider's callback
+type OIDCState struct {
+	ID           string     `json:"-"`
+	Provider     string     `json:"provider"`
+	Nonce        string     `json:"-"`
+	CodeVerifier string     `json:"-"`
+	UserID       *uuid.UUID `json:"user_id"` // Set when linking a provider to an existing account
+	ExpiresAt    time.Time  `json:"expires_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// UserIdentity links a provider account to a user
+type UserIdentity struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       *string    `json:"email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PasskeyCredential struct {
+	ID              string     `json:"id"` // base64url encoded credential ID
+	UserID          uuid.UUID  `json:"user_id"`
+	PublicKey       []byte     `json:"-"`
+	AttestationType string     `json:"-"`
+	Counter         uint32     `json:"-"`
+	AAGUID          []byte     `json:"-"`
+	Transports      []string   `json:"transports"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	DeviceName      *string    `json:"device_name"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+}
+
+type AuthChallenge struct {
+	ID          uuid.UUID  `json:"id"`
+	Challenge   string     `json:"challenge"`
+	UserID      *uuid.UUID `json:"user_id"`
+	Type        string     `json:"type"`
+	SessionData []byte     `json:"-"` // JSON encoded webauthn.SessionData
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+const (
+	ChallengeTypeRegistration   = "registration"
+	ChallengeTypeAuthentication = "authentication"
+)
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes that can be granted to a personal access token
+const (
+	ScopeSessionsRead  = "sessions:read"
+	ScopeSessionsWrite = "sessions:write"
+	ScopeProfileRead   = "profile:read"
+	ScopeProfileWrite  = "profile:write"
+)
+
+// PersonalAccessTokenScopes lists every scope a personal access token can have
+var PersonalAccessTokenScopes = []string{ScopeSessionsRead, ScopeSessionsWrite, ScopeProfileRead, ScopeProfileWrite}
+
+// PersonalAccessToken is a long-lived token for scripts and integrations
+type PersonalAccessToken struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Name        string     `json:"name"`
+	TokenHash   string     `json:"-"`
+	TokenPrefix string     `json:"token_prefix"` // e.g. "slp_Ab3d", to tell tokens apart
+	Scopes      []string   `json:"scopes"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	ExpiresAt   *time.Time `json:"expires_at"` // Never expires when nil
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// HasScope reports whether the token was granted scope
+func (t *PersonalAccessToken) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
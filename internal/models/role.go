@@ -0,0 +1,66 @@
+package models
+
+// User roles
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permissions checked by routes and handlers. The scopes of personal access
+// tokens are permissions as well, so a token can only do what both its scopes
+// and its owner's role allow.
+const (
+	PermissionAccount          = "account" // manage the account itself, never granted to personal access tokens
+	PermissionSessionsRead     = ScopeSessionsRead
+	PermissionSessionsWrite    = ScopeSessionsWrite
+	PermissionProfileRead      = ScopeProfileRead
+	PermissionProfileWrite     = ScopeProfileWrite
+	PermissionSessionsReadAny  = "sessions:read_any" // other users' sessions
+	PermissionSessionsWriteAny = "sessions:write_any"
+	PermissionUsersRead        = "users:read"
+	PermissionUsersManage      = "users:manage"
+	PermissionAuditRead        = "audit:read"
+)
+
+var userPermissions = []string{
+	PermissionAccount,
+	PermissionSessionsRead,
+	PermissionSessionsWrite,
+	PermissionProfileRead,
+	PermissionProfileWrite,
+}
+
+var moderatorPermissions = append([]string{
+	PermissionSessionsReadAny,
+	PermissionSessionsWriteAny,
+	PermissionUsersRead,
+}, userPermissions...)
+
+var adminPermissions = append([]string{
+	PermissionUsersManage,
+	PermissionAuditRead,
+}, moderatorPermissions...)
+
+// RolePermissions lists the permissions of each role
+var RolePermissions = map[string][]string{
+	RoleUser:      userPermissions,
+	RoleModerator: moderatorPermissions,
+	RoleAdmin:     adminPermissions,
+}
+
+// IsValidRole reports whether role is one of the known roles
+func IsValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// RoleHasPermission reports whether role grants permission
+func RoleHasPermission(role, permission string) bool {
+	for _, granted := range RolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -1,28 +1,225 @@
 package models
 
 import (
+	"errors"
+	"math"
 	"time"
 )
 
 type ShishaSession struct {
-	ID           string    `json:"id"`
-	UserID       string    `json:"user_id"`
-	CreatedBy    string    `json:"created_by"`
-	SessionDate  time.Time `json:"session_date"`
-	StoreName    string    `json:"store_name"`
-	Notes        *string   `json:"notes"`
-	OrderDetails *string   `json:"order_details"`
-	MixName      *string   `json:"mix_name"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID              string    `json:"id"`
+	UserID          string    `json:"user_id"`
+	CreatedBy       string    `json:"created_by"`
+	SessionDate     time.Time `json:"session_date"`
+	StoreName       string    `json:"store_name"`
+	Notes           *string   `json:"notes"`
+	OrderDetails    *string   `json:"order_details"`
+	MixName         *string   `json:"mix_name"`
+	BowlWeightGrams *float64  `json:"bowl_weight_grams"`
+	SessionRatings
+	StartedAt   *time.Time `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at"`
+	AutoStopped bool       `json:"auto_stopped"` // stopped by the server after the maximum duration
+	// DurationSeconds is the time from start to stop, or so far while the
+	// session is running
+	DurationSeconds *int64    `json:"duration_seconds"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// ComputeDuration sets DurationSeconds for a session that was started
+func (s *ShishaSession) ComputeDuration(now time.Time) {
+	if s.StartedAt == nil {
+		s.DurationSeconds = nil
+		return
+	}
+
+	end := now
+	if s.EndedAt != nil {
+		end = *s.EndedAt
+	}
+	seconds := int64(end.Sub(*s.StartedAt) / time.Second)
+	s.DurationSeconds = &seconds
+}
+
+// Ratings range from MinRating to MaxRating
+const (
+	MinRating = 1
+	MaxRating = 5
+)
+
+// SessionRatings scores a session. Rating is the overall score, the others
+// rate one aspect each. Any of them may be left out.
+type SessionRatings struct {
+	Rating              *int `json:"rating"`
+	TasteRating         *int `json:"taste_rating"`
+	SmokeVolumeRating   *int `json:"smoke_volume_rating"` // 5 is the most smoke
+	HarshnessRating     *int `json:"harshness_rating"`    // 5 is the harshest
+	HeatStabilityRating *int `json:"heat_stability_rating"`
+	LongevityRating     *int `json:"longevity_rating"`
+}
+
+// SessionRatingFields are the JSON and column names of the ratings sessions can
+// be filtered and sorted by
+var SessionRatingFields = []string{
+	"rating",
+	"taste_rating",
+	"smoke_volume_rating",
+	"harshness_rating",
+	"heat_stability_rating",
+	"longevity_rating",
+}
+
+// SessionSortDate is the default sort field. Sessions can also be sorted by any
+// rating, using its JSON name.
+const SessionSortDate = "session_date"
+
+// IsValidSessionSort reports whether sessions can be sorted by field
+func IsValidSessionSort(field string) bool {
+	return field == SessionSortDate || IsValidSessionRating(field)
+}
+
+// IsValidSessionRating reports whether field is one of SessionRatingFields
+func IsValidSessionRating(field string) bool {
+	for _, rating := range SessionRatingFields {
+		if field == rating {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionFilter selects a user's sessions. Zero values match everything.
+type SessionFilter struct {
+	UserID     string
+	MinRatings map[string]int // by rating field, sessions without that rating never match
+	MaxRatings map[string]int
+	Sort       string // a sort field, SessionSortDate if empty
+	Ascending  bool
+	Limit      int
+	Offset     int
+}
+
+// RatingAverages are the mean ratings over a group of sessions, rounded to two
+// decimals. They are nil where none of the sessions has that rating.
+type RatingAverages struct {
+	Rating              *float64 `json:"rating"`
+	TasteRating         *float64 `json:"taste_rating"`
+	SmokeVolumeRating   *float64 `json:"smoke_volume_rating"`
+	HarshnessRating     *float64 `json:"harshness_rating"`
+	HeatStabilityRating *float64 `json:"heat_stability_rating"`
+	LongevityRating     *float64 `json:"longevity_rating"`
+}
+
+// FlavorStats summarizes the sessions a flavor was smoked in. Flavors are
+// grouped by name and brand, ignoring case.
+type FlavorStats struct {
+	FlavorName     string         `json:"flavor_name"`
+	Brand          *string        `json:"brand"`
+	SessionCount   int            `json:"session_count"`
+	RatedCount     int            `json:"rated_count"` // sessions with an overall rating
+	AverageRatings RatingAverages `json:"average_ratings"`
+}
+
+// MixStats summarizes the sessions with the same combination of flavors,
+// regardless of order and amounts
+type MixStats struct {
+	Flavors        []string       `json:"flavors"`  // as named in the latest session
+	MixName        *string        `json:"mix_name"` // latest name given to the mix
+	SessionCount   int            `json:"session_count"`
+	RatedCount     int            `json:"rated_count"`
+	AverageRatings RatingAverages `json:"average_ratings"`
 }
 
 type SessionFlavor struct {
-	ID         string    `json:"id"`
-	SessionID  string    `json:"session_id"`
-	FlavorName string    `json:"flavor_name"`
-	Brand      *string   `json:"brand"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         string   `json:"id"`
+	SessionID  string   `json:"session_id"`
+	FlavorName string   `json:"flavor_name"`
+	Brand      *string  `json:"brand"`
+	Position   int      `json:"position"` // 0-based order within the session
+	Percentage *float64 `json:"percentage"`
+	Grams      *float64 `json:"grams"`
+	// ComputedGrams is Grams if set, otherwise Percentage of the bowl weight
+	ComputedGrams *float64  `json:"computed_grams"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ComputeGrams sets ComputedGrams, rounded to 0.01 g. It stays nil if neither
+// grams nor both a percentage and the bowl weight are known.
+func (f *SessionFlavor) ComputeGrams(bowlWeightGrams *float64) {
+	switch {
+	case f.Grams != nil:
+		grams := *f.Grams
+		f.ComputedGrams = &grams
+	case f.Percentage != nil && bowlWeightGrams != nil:
+		percentage, bowl := *f.Percentage, *bowlWeightGrams
+		grams := math.Round(percentage*bowl) / 100
+		f.ComputedGrams = &grams
+	default:
+		f.ComputedGrams = nil
+	}
+}
+
+// ErrMixPercentages is returned when some flavors of a mix have a percentage but
+// not all of them do, or they don't add up to 100
+var ErrMixPercentages = errors.New("flavor percentages must be set on every flavor and add up to 100")
+
+// CheckPercentages checks the percentages of a mix's flavors, nil for a flavor
+// without one. A mix without any percentages is fine.
+func CheckPercentages(percentages []*float64) error {
+	var set int
+	var sum float64
+	for _, percentage := range percentages {
+		if percentage != nil {
+			set++
+			sum += *percentage
+		}
+	}
+
+	if set == 0 {
+		return nil
+	}
+	// Percentages have two decimals, allow for float rounding only
+	if set != len(percentages) || math.Abs(sum-100) > 0.001 {
+		return ErrMixPercentages
+	}
+	return nil
+}
+
+// ScalePercentages scales percentages proportionally so they add up to total,
+// keeping two decimals. The rounding difference goes to the largest share. It
+// returns ErrMixPercentages if there is nothing left to share or a share would
+// drop to 0.
+func ScalePercentages(percentages []float64, total float64) ([]float64, error) {
+	hundredths := math.Round(total * 100)
+	var sum float64
+	for _, percentage := range percentages {
+		sum += percentage
+	}
+	if sum <= 0 || hundredths <= 0 {
+		return nil, ErrMixPercentages
+	}
+
+	// Work in hundredths so the result adds up exactly
+	scaled := make([]float64, len(percentages))
+	var assigned float64
+	largest := 0
+	for i, percentage := range percentages {
+		scaled[i] = math.Round(percentage * hundredths / sum)
+		assigned += scaled[i]
+		if scaled[i] > scaled[largest] {
+			largest = i
+		}
+	}
+	scaled[largest] += hundredths - assigned
+
+	for i := range scaled {
+		if scaled[i] <= 0 {
+			return nil, ErrMixPercentages
+		}
+		scaled[i] /= 100
+	}
+	return scaled, nil
 }
 
 type SessionWithFlavors struct {
@@ -31,18 +228,22 @@ type SessionWithFlavors struct {
 }
 
 type CreateSessionRequest struct {
-	UserID       string                `json:"user_id" validate:"required"`
-	SessionDate  time.Time             `json:"session_date" validate:"required"`
-	StoreName    string                `json:"store_name" validate:"required"`
-	Notes        *string               `json:"notes"`
-	OrderDetails *string               `json:"order_details"`
-	MixName      *string               `json:"mix_name"`
-	Flavors      []CreateFlavorRequest `json:"flavors"`
+	UserID          string    `json:"user_id" validate:"required"`
+	SessionDate     time.Time `json:"session_date" validate:"required"`
+	StoreName       string    `json:"store_name" validate:"required"`
+	Notes           *string   `json:"notes"`
+	OrderDetails    *string   `json:"order_details"`
+	MixName         *string   `json:"mix_name"`
+	BowlWeightGrams *float64  `json:"bowl_weight_grams"`
+	SessionRatings
+	Flavors []CreateFlavorRequest `json:"flavors"`
 }
 
 type CreateFlavorRequest struct {
-	FlavorName string  `json:"flavor_name" validate:"required"`
-	Brand      *string `json:"brand"`
+	FlavorName string   `json:"flavor_name" validate:"required"`
+	Brand      *string  `json:"brand"`
+	Percentage *float64 `json:"percentage"`
+	Grams      *float64 `json:"grams"`
 }
 
 type UpdateSessionRequest struct {
@@ -51,4 +252,39 @@ type UpdateSessionRequest struct {
 	Notes        *string    `json:"notes"`
 	OrderDetails *string    `json:"order_details"`
 	MixName      *string    `json:"mix_name"`
+	// BowlWeightGrams of 0 removes the bowl weight
+	BowlWeightGrams *float64 `json:"bowl_weight_grams"`
+	// Ratings of 0 remove them
+	SessionRatings
+	// Flavors replaces the whole flavor list when set, in the given order. An
+	// empty list removes every flavor.
+	Flavors *[]CreateFlavorRequest `json:"flavors"`
+}
+
+// AddFlavorRequest adds a flavor at Position, or at the end if it is omitted.
+// If the mix has percentages, the new flavor needs one too; the other flavors
+// are scaled down to make room for it unless Percentages sets theirs.
+type AddFlavorRequest struct {
+	FlavorName string   `json:"flavor_name" validate:"required"`
+	Brand      *string  `json:"brand"`
+	Percentage *float64 `json:"percentage"`
+	Grams      *float64 `json:"grams"`
+	Position   *int     `json:"position"`
+	// Percentages sets the percentages of other flavors in the same change,
+	// keyed by flavor ID
+	Percentages map[string]float64 `json:"percentages"`
+}
+
+// UpdateFlavorRequest changes the fields that are set. Setting Position moves
+// the flavor and shifts the ones in between; an empty Brand and Grams of 0
+// remove them. A new Percentage scales the other flavors' percentages to make
+// the mix add up to 100 again, unless Percentages sets theirs; a Percentage of
+// 0 removes the percentages of the whole mix.
+type UpdateFlavorRequest struct {
+	FlavorName  *string            `json:"flavor_name"`
+	Brand       *string            `json:"brand"`
+	Percentage  *float64           `json:"percentage"`
+	Grams       *float64           `json:"grams"`
+	Position    *int               `json:"position"`
+	Percentages map[string]float64 `json:"percentages"`
 }
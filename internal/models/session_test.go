@@ -0,0 +1,63 @@
+package models
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScalePercentages(t *testing.T) {
+	tests := []struct {
+		name        string
+		percentages []float64
+		total       float64
+		want        []float64
+		wantErr     bool
+	}{
+		{name: "already adds up", percentages: []float64{50, 50}, total: 100, want: []float64{50, 50}},
+		{name: "scales down", percentages: []float64{30, 20}, total: 80, want: []float64{48, 32}},
+		{name: "rounds without a remainder", percentages: []float64{2, 1}, total: 50, want: []float64{33.33, 16.67}},
+		{name: "missing hundredth goes to the largest share", percentages: []float64{1, 1, 2, 2, 3}, total: 100, want: []float64{11.11, 11.11, 22.22, 22.22, 33.34}},
+		{name: "missing hundredth goes to the first of equal shares", percentages: []float64{1, 1, 1}, total: 100, want: []float64{33.34, 33.33, 33.33}},
+		{name: "extra hundredth comes off the first of equal shares", percentages: []float64{1, 1, 1}, total: 50, want: []float64{16.66, 16.67, 16.67}},
+		{name: "extra hundredth comes off the largest share", percentages: []float64{1, 1, 1, 3}, total: 100, want: []float64{16.67, 16.67, 16.67, 49.99}},
+		{name: "total with more than two decimals", percentages: []float64{1, 1}, total: 99.999, want: []float64{50, 50}},
+		{name: "no shares", percentages: nil, total: 100, wantErr: true},
+		{name: "zero shares", percentages: []float64{0, 0}, total: 100, wantErr: true},
+		{name: "zero total", percentages: []float64{50, 50}, total: 0, wantErr: true},
+		{name: "negative total", percentages: []float64{50, 50}, total: -100, wantErr: true},
+		{name: "negative sum", percentages: []float64{-10, 5}, total: 100, wantErr: true},
+		{name: "negative share", percentages: []float64{-10, 50}, total: 100, wantErr: true},
+		{name: "share rounds to 0", percentages: []float64{0.001, 99.999}, total: 100, wantErr: true},
+		{name: "share rounds to 0 after scaling down", percentages: []float64{1, 99}, total: 0.4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ScalePercentages(tt.percentages, tt.total)
+			if tt.wantErr {
+				if err != ErrMixPercentages {
+					t.Fatalf("ScalePercentages(%v, %v) = %v, %v, want ErrMixPercentages", tt.percentages, tt.total, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ScalePercentages(%v, %v): %v", tt.percentages, tt.total, err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("ScalePercentages(%v, %v) = %v, want %v", tt.percentages, tt.total, got, tt.want)
+			}
+			var hundredths float64
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ScalePercentages(%v, %v) = %v, want %v", tt.percentages, tt.total, got, tt.want)
+					break
+				}
+				hundredths += math.Round(got[i] * 100)
+			}
+			if hundredths != math.Round(tt.total*100) {
+				t.Errorf("shares add up to %v hundredths, want %v", hundredths, math.Round(tt.total*100))
+			}
+		})
+	}
+}
@@ -7,19 +7,67 @@ import (
 )
 
 type User struct {
-	ID           uuid.UUID `json:"id"`
-	UserID       string    `json:"user_id"`
-	PasswordHash string    `json:"-"` // Never expose password hash in JSON
-	DisplayName  string    `json:"display_name"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID                    uuid.UUID  `json:"id"`
+	UserID                string     `json:"user_id"`
+	PasswordHash          string     `json:"-"` // Never expose password hash in JSON
+	DisplayName           string     `json:"display_name"`
+	Role                  string     `json:"role"`            // RoleUser, RoleModerator or RoleAdmin
+	Email                 *string    `json:"email,omitempty"` // Only set once verified
+	EmailVerifiedAt       *time.Time `json:"email_verified_at,omitempty"`
+	TokenVersion          int        `json:"-"`                                // Incremented to invalidate all issued access tokens
+	DeletionScheduledFor  *time.Time `json:"deletion_scheduled_for,omitempty"` // Set while a deletion request is pending
+	UserIDChangedAt       *time.Time `json:"user_id_changed_at,omitempty"`
+	SuspendedAt           *time.Time `json:"suspended_at,omitempty"`
+	SuspensionReason      *string    `json:"suspension_reason,omitempty"`
+	PasswordResetRequired bool       `json:"password_reset_required,omitempty"` // Set by an admin, cleared by the next password change
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+}
+
+// UserAuthStatus is what the auth middleware checks on every request
+type UserAuthStatus struct {
+	TokenVersion      int
+	Role              string
+	Suspended         bool
+	DeletionScheduled bool
+}
+
+// UserFilter selects users in the admin user list
+type UserFilter struct {
+	Query     string // matched against user ID, display name and email
+	Role      string
+	Suspended *bool
+	Limit     int
+	Offset    int
 }
 
 type PasswordResetToken struct {
 	ID        uuid.UUID `json:"id"`
 	UserID    uuid.UUID `json:"user_id"`
-	Token     string    `json:"token"`
+	TokenHash string    `json:"-"` // SHA-256 of the token sent to the user
 	ExpiresAt time.Time `json:"expires_at"`
 	Used      bool      `json:"used"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// Email verification token purposes
+const (
+	EmailTokenVerify        = "verify"         // sent to the new address
+	EmailTokenApproveChange = "approve_change" // sent to the current address when changing it
+)
+
+// EmailVerificationToken is a link sent to confirm an address. Setting an
+// address creates one token, changing a verified address creates one for each
+// address under the same RequestID and the change applies once both are used.
+type EmailVerificationToken struct {
+	ID        uuid.UUID  `json:"id"`
+	RequestID uuid.UUID  `json:"request_id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	Email     string     `json:"email"` // address being verified
+	Purpose   string     `json:"purpose"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	SentAt    time.Time  `json:"sent_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
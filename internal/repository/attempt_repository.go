@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+// AttemptRepository is the Postgres backed service.AttemptStore, shared by every
+// instance of the API. Expired rows are removed by cleanup_expired_tokens().
+type AttemptRepository struct {
+	db *sql.DB
+}
+
+func NewAttemptRepository(db *sql.DB) *AttemptRepository {
+	return &AttemptRepository{db: db}
+}
+
+func (r *AttemptRepository) Hit(key string, window time.Duration) (*models.AuthAttempt, error) {
+	record := &models.AuthAttempt{}
+	now := time.Now()
+	query := `
+		INSERT INTO auth_attempts (key, count, window_start, last_attempt_at, expires_at)
+		VALUES ($1, 1, $2, $2, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET count = CASE WHEN auth_attempts.expires_at <= $2 THEN 1 ELSE auth_attempts.count + 1 END,
+			window_start = CASE WHEN auth_attempts.expires_at <= $2 THEN $2 ELSE auth_attempts.window_start END,
+			expires_at = CASE WHEN auth_attempts.expires_at <= $2 THEN $3 ELSE auth_attempts.expires_at END,
+			last_attempt_at = $2
+		RETURNING count, window_start, last_attempt_at
+	`
+
+	err := r.db.QueryRow(query, key, now, now.Add(window)).
+		Scan(&record.Count, &record.WindowStart, &record.LastAttempt)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (r *AttemptRepository) Get(key string) (*models.AuthAttempt, error) {
+	record := &models.AuthAttempt{}
+	query := `
+		SELECT count, window_start, last_attempt_at
+		FROM auth_attempts
+		WHERE key = $1 AND expires_at > NOW()
+	`
+
+	err := r.db.QueryRow(query, key).Scan(&record.Count, &record.WindowStart, &record.LastAttempt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (r *AttemptRepository) Reset(key string) error {
+	_, err := r.db.Exec(`DELETE FROM auth_attempts WHERE key = $1`, key)
+	return err
+}
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+type AuditRepository struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+func (r *AuditRepository) Create(event *models.AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (id, user_id, actor_id, account, event_type, outcome, reason, ip_address, user_agent, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	_, err := r.db.Exec(query, uuid.New(), event.UserID, event.ActorID, event.Account, event.EventType,
+		event.Outcome, event.Reason, event.IPAddress, event.UserAgent, time.Now())
+	return err
+}
+
+// List returns the events matching the filter, newest first
+func (r *AuditRepository) List(filter models.AuditEventFilter) ([]models.AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UserID != nil {
+		where("user_id = $%d", *filter.UserID)
+	}
+	if filter.EventType != "" {
+		where("event_type = $%d", filter.EventType)
+	}
+	if filter.Outcome != "" {
+		where("outcome = $%d", filter.Outcome)
+	}
+	if filter.IPAddress != "" {
+		where("ip_address = $%d", filter.IPAddress)
+	}
+	if filter.Since != nil {
+		where("created_at >= $%d", *filter.Since)
+	}
+	if filter.Until != nil {
+		where("created_at < $%d", *filter.Until)
+	}
+
+	query := `
+		SELECT id, user_id, actor_id, account, event_type, outcome, reason, ip_address, user_agent, created_at
+		FROM audit_events`
+	if len(conditions) > 0 {
+		query += `
+		WHERE ` + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	query += fmt.Sprintf(`
+		ORDER BY created_at DESC
+		LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var event models.AuditEvent
+		err := rows.Scan(&event.ID, &event.UserID, &event.ActorID, &event.Account, &event.EventType,
+			&event.Outcome, &event.Reason, &event.IPAddress, &event.UserAgent, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
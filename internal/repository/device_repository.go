@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+type DeviceRepository struct {
+	db *sql.DB
+}
+
+func NewDeviceRepository(db *sql.DB) *DeviceRepository {
+	return &DeviceRepository{db: db}
+}
+
+// Save records a device after a login. For a device that already exists only
+// its last-seen time, IP address and expiry change. Refresh token rotation
+// updates the device with RefreshTokenRepository.Rotate.
+func (r *DeviceRepository) Save(device *models.AuthDevice) error {
+	query := `
+		INSERT INTO auth_devices (id, user_id, device_label, user_agent, ip_address, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
+		ON CONFLICT (id) DO UPDATE
+		SET last_seen_at = EXCLUDED.last_seen_at, ip_address = EXCLUDED.ip_address, expires_at = EXCLUDED.expires_at
+	`
+
+	_, err := r.db.Exec(query, device.ID, device.UserID, device.DeviceLabel, device.UserAgent, device.IPAddress,
+		time.Now(), device.ExpiresAt)
+	return err
+}
+
+func (r *DeviceRepository) GetByUserID(userID uuid.UUID) ([]models.AuthDevice, error) {
+	query := `
+		SELECT id, user_id, device_label, user_agent, ip_address, created_at, last_seen_at, expires_at
+		FROM auth_devices
+		WHERE user_id = $1 AND expires_at > NOW()
+		ORDER BY last_seen_at DESC
+	`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []models.AuthDevice{}
+	for rows.Next() {
+		var device models.AuthDevice
+		err := rows.Scan(&device.ID, &device.UserID, &device.DeviceLabel, &device.UserAgent, &device.IPAddress,
+			&device.CreatedAt, &device.LastSeenAt, &device.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// IsActive reports whether the device is still signed in
+func (r *DeviceRepository) IsActive(id uuid.UUID) (bool, error) {
+	var active bool
+	query := `SELECT EXISTS (SELECT 1 FROM auth_devices WHERE id = $1 AND expires_at > NOW())`
+
+	err := r.db.QueryRow(query, id).Scan(&active)
+	return active, err
+}
+
+// Touch records activity from the device. It returns sql.ErrNoRows if the device
+// has been signed out.
+func (r *DeviceRepository) Touch(id uuid.UUID, ipAddress string, seenAt time.Time) error {
+	query := `
+		UPDATE auth_devices
+		SET last_seen_at = $2, ip_address = $3
+		WHERE id = $1 AND expires_at > NOW()
+	`
+
+	result, err := r.db.Exec(query, id, seenAt, ipAddress)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
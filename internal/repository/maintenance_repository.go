@@ -0,0 +1,22 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+)
+
+// MaintenanceRepository runs housekeeping functions defined in the migrations
+type MaintenanceRepository struct {
+	db *sql.DB
+}
+
+func NewMaintenanceRepository(db *sql.DB) *MaintenanceRepository {
+	return &MaintenanceRepository{db: db}
+}
+
+// CleanupExpiredTokens deletes expired reset, refresh and verification tokens,
+// revocation entries and attempt counters
+func (r *MaintenanceRepository) CleanupExpiredTokens(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `SELECT cleanup_expired_tokens()`)
+	return err
+}
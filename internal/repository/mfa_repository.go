@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+type MFARepository struct {
+	db *sql.DB
+}
+
+func NewMFARepository(db *sql.DB) *MFARepository {
+	return &MFARepository{db: db}
+}
+
+// SavePendingTOTP stores a new secret that is not enabled until confirmed. It
+// replaces any earlier unconfirmed secret but never an enabled one.
+func (r *MFARepository) SavePendingTOTP(userID uuid.UUID, encryptedSecret string) error {
+	query := `
+		INSERT INTO user_mfa (user_id, totp_secret, created_at, updated_at)
+		VALUES ($1, $2, $3, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET totp_secret = EXCLUDED.totp_secret, last_used_step = 0
+		WHERE user_mfa.enabled_at IS NULL
+	`
+
+	result, err := r.db.Exec(query, userID, encryptedSecret, time.Now())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func (r *MFARepository) GetByUserID(userID uuid.UUID) (*models.UserMFA, error) {
+	mfa := &models.UserMFA{}
+	query := `
+		SELECT user_id, totp_secret, enabled_at, last_used_step, created_at, updated_at
+		FROM user_mfa
+		WHERE user_id = $1
+	`
+
+	err := r.db.QueryRow(query, userID).
+		Scan(&mfa.UserID, &mfa.TOTPSecret, &mfa.EnabledAt, &mfa.LastUsedStep, &mfa.CreatedAt, &mfa.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return mfa, nil
+}
+
+// IsEnabled reports whether the user has confirmed TOTP enrollment
+func (r *MFARepository) IsEnabled(userID uuid.UUID) (bool, error) {
+	var enabled bool
+	query := `SELECT EXISTS (SELECT 1 FROM user_mfa WHERE user_id = $1 AND enabled_at IS NOT NULL)`
+
+	err := r.db.QueryRow(query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// UseStep records the time step of an accepted code. It returns sql.ErrNoRows if
+// the same or a later step was already used, so each code only works once.
+func (r *MFARepository) UseStep(userID uuid.UUID, step int64) error {
+	query := `
+		UPDATE user_mfa
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2
+	`
+
+	result, err := r.db.Exec(query, userID, step)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// Enable confirms enrollment and stores a fresh set of recovery codes
+func (r *MFARepository) Enable(userID uuid.UUID, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE user_mfa SET enabled_at = $2 WHERE user_id = $1 AND enabled_at IS NULL`, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Disable removes the TOTP secret and all recovery codes
+func (r *MFARepository) Disable(userID uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_mfa WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Recovery code methods
+
+func (r *MFARepository) ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ConsumeRecoveryCode marks an unused code as used. It returns sql.ErrNoRows if
+// the code does not exist or was already used.
+func (r *MFARepository) ConsumeRecoveryCode(userID uuid.UUID, codeHash string) error {
+	query := `
+		UPDATE mfa_recovery_codes
+		SET used_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+
+	result, err := r.db.Exec(query, userID, codeHash, time.Now())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func (r *MFARepository) CountUnusedRecoveryCodes(userID uuid.UUID) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL`
+
+	err := r.db.QueryRow(query, userID).Scan(&count)
+	return count, err
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID uuid.UUID, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, codeHash := range codeHashes {
+		query := `
+			INSERT INTO mfa_recovery_codes (id, user_id, code_hash, created_at)
+			VALUES ($1, $2, $3, $4)
+		`
+		if _, err := tx.Exec(query, uuid.New(), userID, codeHash, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
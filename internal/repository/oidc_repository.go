@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+type OIDCRepository struct {
+	db *sql.DB
+}
+
+func NewOIDCRepository(db *sql.DB) *OIDCRepository {
+	return &OIDCRepository{db: db}
+}
+
+// State methods
+
+func (r *OIDCRepository) CreateState(state *models.OIDCState) error {
+	query := `
+		INSERT INTO oidc_states (id, provider, nonce, code_verifier, user_id, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	_, err := r.db.Exec(query, state.ID, state.Provider, state.Nonce, state.CodeVerifier, state.UserID,
+		state.ExpiresAt, time.Now())
+	return err
+}
+
+// ConsumeState deletes and returns an unexpired state so a callback can only be used once
+func (r *OIDCRepository) ConsumeState(id, provider string) (*models.OIDCState, error) {
+	state := &models.OIDCState{}
+	query := `
+		DELETE FROM oidc_states
+		WHERE id = $1 AND provider = $2 AND expires_at > NOW()
+		RETURNING id, provider, nonce, code_verifier, user_id, expires_at, created_at
+	`
+
+	err := r.db.QueryRow(query, id, provider).
+		Scan(&state.ID, &state.Provider, &state.Nonce, &state.CodeVerifier, &state.UserID,
+			&state.ExpiresAt, &state.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Identity methods
+
+const identityColumns = `id, user_id, provider, subject, email, created_at, last_login_at`
+
+func scanIdentity(row interface{ Scan(...interface{}) error }) (*models.UserIdentity, error) {
+	identity := &models.UserIdentity{}
+	var email sql.NullString
+	var lastLoginAt sql.NullTime
+
+	err := row.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &email,
+		&identity.CreatedAt, &lastLoginAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if email.Valid {
+		identity.Email = &email.String
+	}
+	if lastLoginAt.Valid {
+		identity.LastLoginAt = &lastLoginAt.Time
+	}
+
+	return identity, nil
+}
+
+func (r *OIDCRepository) GetIdentity(provider, subject string) (*models.UserIdentity, error) {
+	query := `SELECT ` + identityColumns + ` FROM user_identities WHERE provider = $1 AND subject = $2`
+	return scanIdentity(r.db.QueryRow(query, provider, subject))
+}
+
+func (r *OIDCRepository) GetIdentitiesByUserID(userID uuid.UUID) ([]models.UserIdentity, error) {
+	query := `SELECT ` + identityColumns + ` FROM user_identities WHERE user_id = $1 ORDER BY created_at`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []models.UserIdentity{}
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, *identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// CreateIdentity links a provider account to an existing user. It returns
+// ErrDuplicate if the provider account is already linked.
+func (r *OIDCRepository) CreateIdentity(userID uuid.UUID, provider, subject string, email *string) (*models.UserIdentity, error) {
+	query := `
+		INSERT INTO user_identities (id, user_id, provider, subject, email, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + identityColumns
+
+	identity, err := scanIdentity(r.db.QueryRow(query, uuid.New(), userID, provider, subject, email, time.Now()))
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicate
+	}
+	return identity, err
+}
+
+// TouchIdentity records a login and refreshes the email the provider reported
+func (r *OIDCRepository) TouchIdentity(id uuid.UUID, email *string) error {
+	query := `UPDATE user_identities SET email = $2, last_login_at = $3 WHERE id = $1`
+	_, err := r.db.Exec(query, id, email, time.Now())
+	return err
+}
+
+// DeleteIdentity unlinks a provider account. It returns sql.ErrNoRows if the
+// identity does not exist or belongs to another user.
+func (r *OIDCRepository) DeleteIdentity(userID, id uuid.UUID) error {
+	result, err := r.db.Exec(`DELETE FROM user_identities WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// ProvisionUser creates a user without a password together with its first
+// identity. It returns ErrDuplicate if the user ID is taken or the provider
+// account is already linked.
+func (r *OIDCRepository) ProvisionUser(userID, displayName, provider, subject string, email *string) (*models.User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `
+		INSERT INTO users (id, user_id, password_hash, display_name, created_at, updated_at)
+		VALUES ($1, $2, '', $3, $4, $4)
+		RETURNING ` + userColumns
+
+	user, err := scanUser(tx.QueryRow(query, uuid.New(), userID, displayName, now))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicate
+		}
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO user_identities (id, user_id, provider, subject, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+	`
+	if _, err := tx.Exec(query, uuid.New(), user.ID, provider, subject, email, now); err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicate
+		}
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
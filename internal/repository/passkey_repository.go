@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+type PasskeyRepository struct {
+	db *sql.DB
+}
+
+func NewPasskeyRepository(db *sql.DB) *PasskeyRepository {
+	return &PasskeyRepository{db: db}
+}
+
+const passkeyColumns = `id, user_id, public_key, attestation_type, counter, aaguid, transports,
+		backup_eligible, backup_state, device_name, created_at, last_used_at`
+
+func scanPasskey(row interface{ Scan(...interface{}) error }) (*models.PasskeyCredential, error) {
+	credential := &models.PasskeyCredential{}
+	var attestationType sql.NullString
+	var counter int64
+
+	err := row.Scan(&credential.ID, &credential.UserID, &credential.PublicKey, &attestationType, &counter,
+		&credential.AAGUID, pq.Array(&credential.Transports), &credential.BackupEligible, &credential.BackupState,
+		&credential.DeviceName, &credential.CreatedAt, &credential.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	credential.AttestationType = attestationType.String
+	credential.Counter = uint32(counter)
+	return credential, nil
+}
+
+func (r *PasskeyRepository) CreateCredential(credential *models.PasskeyCredential) error {
+	query := `
+		INSERT INTO passkey_credentials (id, user_id, public_key, attestation_type, counter, aaguid, transports,
+			backup_eligible, backup_state, device_name, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`
+
+	credential.CreatedAt = time.Now()
+	_, err := r.db.Exec(query, credential.ID, credential.UserID, credential.PublicKey, credential.AttestationType,
+		int64(credential.Counter), credential.AAGUID, pq.Array(credential.Transports), credential.BackupEligible,
+		credential.BackupState, credential.DeviceName, credential.CreatedAt)
+	return err
+}
+
+func (r *PasskeyRepository) GetCredentialByID(id string) (*models.PasskeyCredential, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM passkey_credentials WHERE id = $1`
+	return scanPasskey(r.db.QueryRow(query, id))
+}
+
+func (r *PasskeyRepository) GetCredentialsByUserID(userID uuid.UUID) ([]models.PasskeyCredential, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM passkey_credentials WHERE user_id = $1 ORDER BY created_at`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []models.PasskeyCredential{}
+	for rows.Next() {
+		credential, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, *credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+// UpdateCredentialUsage stores the new sign counter and backup state after a successful login
+func (r *PasskeyRepository) UpdateCredentialUsage(id string, counter uint32, backupState bool) error {
+	query := `
+		UPDATE passkey_credentials
+		SET counter = $2, backup_state = $3, last_used_at = $4
+		WHERE id = $1
+	`
+
+	_, err := r.db.Exec(query, id, int64(counter), backupState, time.Now())
+	return err
+}
+
+func (r *PasskeyRepository) RenameCredential(userID uuid.UUID, id, deviceName string) error {
+	query := `
+		UPDATE passkey_credentials
+		SET device_name = $3
+		WHERE id = $1 AND user_id = $2
+	`
+
+	result, err := r.db.Exec(query, id, userID, deviceName)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func (r *PasskeyRepository) DeleteCredential(userID uuid.UUID, id string) error {
+	query := `DELETE FROM passkey_credentials WHERE id = $1 AND user_id = $2`
+
+	result, err := r.db.Exec(query, id, userID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// Challenge methods
+
+func (r *PasskeyRepository) CreateChallenge(challenge *models.AuthChallenge) error {
+	query := `
+		INSERT INTO auth_challenges (id, challenge, user_id, type, session_data, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	challenge.ID = uuid.New()
+	challenge.CreatedAt = time.Now()
+	_, err := r.db.Exec(query, challenge.ID, challenge.Challenge, challenge.UserID, challenge.Type,
+		challenge.SessionData, challenge.ExpiresAt, challenge.CreatedAt)
+	return err
+}
+
+// ConsumeChallenge deletes and returns an unexpired challenge so it can only be used once
+func (r *PasskeyRepository) ConsumeChallenge(id uuid.UUID, challengeType string) (*models.AuthChallenge, error) {
+	challenge := &models.AuthChallenge{}
+	query := `
+		DELETE FROM auth_challenges
+		WHERE id = $1 AND type = $2 AND expires_at > NOW()
+		RETURNING id, challenge, user_id, type, session_data, expires_at, created_at
+	`
+
+	err := r.db.QueryRow(query, id, challengeType).
+		Scan(&challenge.ID, &challenge.Challenge, &challenge.UserID, &challenge.Type, &challenge.SessionData,
+			&challenge.ExpiresAt, &challenge.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+type PersonalAccessTokenRepository struct {
+	db *sql.DB
+}
+
+func NewPersonalAccessTokenRepository(db *sql.DB) *PersonalAccessTokenRepository {
+	return &PersonalAccessTokenRepository{db: db}
+}
+
+const personalAccessTokenColumns = `id, user_id, name, token_hash, token_prefix, scopes, last_used_at, expires_at, created_at`
+
+func scanPersonalAccessToken(row interface{ Scan(...interface{}) error }) (*models.PersonalAccessToken, error) {
+	token := &models.PersonalAccessToken{}
+	var lastUsedAt sql.NullTime
+	var expiresAt sql.NullTime
+
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.TokenPrefix,
+		pq.Array(&token.Scopes), &lastUsedAt, &expiresAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+
+	return token, nil
+}
+
+func (r *PersonalAccessTokenRepository) Create(token *models.PersonalAccessToken) (*models.PersonalAccessToken, error) {
+	query := `
+		INSERT INTO personal_access_tokens (id, user_id, name, token_hash, token_prefix, scopes, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING ` + personalAccessTokenColumns
+
+	return scanPersonalAccessToken(r.db.QueryRow(query, uuid.New(), token.UserID, token.Name, token.TokenHash,
+		token.TokenPrefix, pq.Array(token.Scopes), token.ExpiresAt, time.Now()))
+}
+
+// GetByHash returns an unexpired token
+func (r *PersonalAccessTokenRepository) GetByHash(tokenHash string) (*models.PersonalAccessToken, error) {
+	query := `
+		SELECT ` + personalAccessTokenColumns + `
+		FROM personal_access_tokens
+		WHERE token_hash = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`
+	return scanPersonalAccessToken(r.db.QueryRow(query, tokenHash))
+}
+
+func (r *PersonalAccessTokenRepository) GetByUserID(userID uuid.UUID) ([]models.PersonalAccessToken, error) {
+	query := `
+		SELECT ` + personalAccessTokenColumns + `
+		FROM personal_access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.PersonalAccessToken{}
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// TouchLastUsed records that the token was used. Writes are skipped when the
+// token was already used within the last minute.
+func (r *PersonalAccessTokenRepository) TouchLastUsed(id uuid.UUID, usedAt time.Time) error {
+	query := `
+		UPDATE personal_access_tokens
+		SET last_used_at = $2
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2 - INTERVAL '1 minute')
+	`
+
+	_, err := r.db.Exec(query, id, usedAt)
+	return err
+}
+
+// Delete revokes one of the user's tokens. It returns sql.ErrNoRows if the token
+// does not exist or belongs to another user.
+func (r *PersonalAccessTokenRepository) Delete(userID, id uuid.UUID) error {
+	result, err := r.db.Exec(`DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// DeleteByUserID revokes every token of the user
+func (r *PersonalAccessTokenRepository) DeleteByUserID(userID uuid.UUID) error {
+	_, err := r.db.Exec(`DELETE FROM personal_access_tokens WHERE user_id = $1`, userID)
+	return err
+}
@@ -61,3 +61,13 @@ func (r *ProfileRepository) Update(ctx context.Context, id string, displayName s
 
 	return err
 }
+
+// Delete removes the profile. Deleting a missing profile is not an error.
+func (r *ProfileRepository) Delete(ctx context.Context, id string) error {
+	_, _, err := r.client.From("profiles").
+		Delete("", "").
+		Eq("id", id).
+		Execute()
+
+	return err
+}
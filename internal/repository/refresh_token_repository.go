@@ -0,0 +1,181 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+type RefreshTokenRepository struct {
+	db *sql.DB
+}
+
+func NewRefreshTokenRepository(db *sql.DB) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: db}
+}
+
+func (r *RefreshTokenRepository) Create(token *models.RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	token.ID = uuid.New()
+	token.CreatedAt = time.Now()
+	_, err := r.db.Exec(query, token.ID, token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	return err
+}
+
+// GetByHash returns the token regardless of its state so callers can detect reuse
+func (r *RefreshTokenRepository) GetByHash(tokenHash string) (*models.RefreshToken, error) {
+	token := &models.RefreshToken{}
+	query := `
+		SELECT id, user_id, family_id, token_hash, expires_at, used_at, revoked_at, created_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`
+
+	err := r.db.QueryRow(query, tokenHash).
+		Scan(&token.ID, &token.UserID, &token.FamilyID, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.RevokedAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Rotate flags the used token as rotated, stores its successor and refreshes
+// the device in one transaction. The family's tokens are locked first, so a
+// concurrent RevokeDevice or RevokeAllForUser either runs before and makes
+// Rotate return sql.ErrNoRows, or runs after and revokes the new token as well.
+// It also returns sql.ErrNoRows if the token was already used, which happens
+// when two requests race with the same token, or if the device is gone.
+func (r *RefreshTokenRepository) Rotate(usedID uuid.UUID, next *models.RefreshToken, device *models.AuthDevice) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT id FROM refresh_tokens WHERE family_id = $1 ORDER BY id FOR UPDATE`, next.FamilyID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	query := `
+		UPDATE refresh_tokens
+		SET used_at = $2
+		WHERE id = $1 AND used_at IS NULL AND revoked_at IS NULL
+	`
+	result, err := tx.Exec(query, usedID, now)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	next.ID = uuid.New()
+	next.CreatedAt = now
+	if _, err := tx.Exec(query, next.ID, next.UserID, next.FamilyID, next.TokenHash, next.ExpiresAt, next.CreatedAt); err != nil {
+		return err
+	}
+
+	// A signed out device stays signed out
+	query = `
+		UPDATE auth_devices
+		SET last_seen_at = $3, ip_address = $4, expires_at = $5
+		WHERE id = $1 AND user_id = $2
+	`
+	result, err = tx.Exec(query, device.ID, device.UserID, now, device.IPAddress, device.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeDevice signs out one of the user's devices: it deletes the device and
+// revokes its token family in one transaction, holding the same lock as Rotate.
+// It returns sql.ErrNoRows if the device does not exist or belongs to another
+// user.
+func (r *RefreshTokenRepository) RevokeDevice(userID, familyID uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT id FROM refresh_tokens WHERE family_id = $1 ORDER BY id FOR UPDATE`, familyID); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`DELETE FROM auth_devices WHERE id = $1 AND user_id = $2`, familyID, userID)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = $2
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`
+	if _, err := tx.Exec(query, familyID, time.Now()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *RefreshTokenRepository) RevokeFamily(familyID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = $2
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`
+
+	_, err := r.db.Exec(query, familyID, time.Now())
+	return err
+}
+
+// RevokeAllForUser revokes every refresh token of the user and deletes their
+// devices in one transaction. It locks the user's tokens in the same order as
+// Rotate, so a token rotated concurrently is revoked as well.
+func (r *RefreshTokenRepository) RevokeAllForUser(userID uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT id FROM refresh_tokens WHERE user_id = $1 ORDER BY id FOR UPDATE`, userID); err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = $2
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`
+	if _, err := tx.Exec(query, userID, time.Now()); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM auth_devices WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RevocationRepository is the Postgres backed service.RevocationStore, shared by
+// every instance of the API. Expired rows are removed by cleanup_expired_tokens().
+type RevocationRepository struct {
+	db *sql.DB
+}
+
+func NewRevocationRepository(db *sql.DB) *RevocationRepository {
+	return &RevocationRepository{db: db}
+}
+
+func (r *RevocationRepository) Revoke(jti string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO revoked_tokens (jti, expires_at, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING
+	`
+
+	_, err := r.db.Exec(query, jti, expiresAt, time.Now())
+	return err
+}
+
+func (r *RevocationRepository) RevokeAllForUser(userID uuid.UUID, issuedBefore, expiresAt time.Time) error {
+	query := `
+		INSERT INTO user_token_revocations (user_id, issued_before, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET issued_before = GREATEST(user_token_revocations.issued_before, EXCLUDED.issued_before),
+			expires_at = GREATEST(user_token_revocations.expires_at, EXCLUDED.expires_at)
+	`
+
+	_, err := r.db.Exec(query, userID, issuedBefore, expiresAt)
+	return err
+}
+
+func (r *RevocationRepository) IsRevoked(jti string, userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+			OR EXISTS (SELECT 1 FROM user_token_revocations WHERE user_id = $2 AND issued_before > $3)
+	`
+
+	err := r.db.QueryRow(query, jti, userID, issuedAt).Scan(&revoked)
+	return revoked, err
+}
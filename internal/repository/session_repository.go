@@ -2,233 +2,949 @@ package repository
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/supabase-community/supabase-go"
+	"github.com/lib/pq"
 	"github.com/toof-jp/shisha-log-backend/internal/models"
 )
 
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrFlavorNotFound      = errors.New("flavor not found")
+	ErrSessionStarted      = errors.New("session already started")
+	ErrSessionNotRunning   = errors.New("session is not running")
+	ErrOtherSessionRunning = errors.New("another session is running")
+)
+
+// SessionRepository stores sessions and their child rows. Writes that touch more
+// than one table run in a transaction; child tables reference shisha_sessions
+// with ON DELETE CASCADE, so deleting a session removes everything it owns.
 type SessionRepository struct {
-	client *supabase.Client
+	db *sql.DB
 }
 
-func NewSessionRepository(client *supabase.Client) *SessionRepository {
-	return &SessionRepository{client: client}
+func NewSessionRepository(db *sql.DB) *SessionRepository {
+	return &SessionRepository{db: db}
 }
 
-func (r *SessionRepository) Create(ctx context.Context, session *models.ShishaSession, flavors []models.CreateFlavorRequest) (*models.SessionWithFlavors, error) {
-	// Start transaction by creating session first
-	var createdSessions []models.ShishaSession
-	session.ID = uuid.New().String()
+const ratingColumns = `rating, taste_rating, smoke_volume_rating, harshness_rating, heat_stability_rating,
+		longevity_rating`
 
-	data, _, err := r.client.From("shisha_sessions").
-		Insert(session, false, "", "", "").
-		Execute()
+const sessionColumns = `id, user_id, created_by, session_date, store_name, notes, order_details, mix_name,
+		bowl_weight_grams, ` + ratingColumns + `, started_at, ended_at, auto_stopped, created_at, updated_at`
 
+func scanSession(row interface{ Scan(...interface{}) error }) (*models.ShishaSession, error) {
+	session := &models.ShishaSession{}
+	var notes, orderDetails, mixName sql.NullString
+	var bowlWeightGrams sql.NullFloat64
+	var startedAt, endedAt sql.NullTime
+
+	err := row.Scan(&session.ID, &session.UserID, &session.CreatedBy, &session.SessionDate, &session.StoreName,
+		&notes, &orderDetails, &mixName, &bowlWeightGrams, &session.Rating, &session.TasteRating,
+		&session.SmokeVolumeRating, &session.HarshnessRating, &session.HeatStabilityRating, &session.LongevityRating,
+		&startedAt, &endedAt, &session.AutoStopped, &session.CreatedAt, &session.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(data, &createdSessions)
+	if notes.Valid {
+		session.Notes = &notes.String
+	}
+	if orderDetails.Valid {
+		session.OrderDetails = &orderDetails.String
+	}
+	if mixName.Valid {
+		session.MixName = &mixName.String
+	}
+	if bowlWeightGrams.Valid {
+		session.BowlWeightGrams = &bowlWeightGrams.Float64
+	}
+	if startedAt.Valid {
+		session.StartedAt = &startedAt.Time
+	}
+	if endedAt.Valid {
+		session.EndedAt = &endedAt.Time
+	}
+	session.ComputeDuration(time.Now())
+
+	return session, nil
+}
+
+const flavorColumns = `id, session_id, flavor_name, brand, position, percentage, grams, created_at`
+
+func scanFlavor(row interface{ Scan(...interface{}) error }) (*models.SessionFlavor, error) {
+	flavor := &models.SessionFlavor{}
+	var brand sql.NullString
+	var percentage, grams sql.NullFloat64
+
+	err := row.Scan(&flavor.ID, &flavor.SessionID, &flavor.FlavorName, &brand, &flavor.Position, &percentage, &grams,
+		&flavor.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(createdSessions) == 0 {
-		return nil, errors.New("failed to create session")
+	if brand.Valid {
+		flavor.Brand = &brand.String
+	}
+	if percentage.Valid {
+		flavor.Percentage = &percentage.Float64
+	}
+	if grams.Valid {
+		flavor.Grams = &grams.Float64
 	}
 
-	createdSession := createdSessions[0]
+	return flavor, nil
+}
 
-	// Create flavors
-	var sessionFlavors []models.SessionFlavor
-	for _, flavor := range flavors {
-		sessionFlavor := models.SessionFlavor{
-			ID:         uuid.New().String(),
-			SessionID:  createdSession.ID,
-			FlavorName: flavor.FlavorName,
-			Brand:      flavor.Brand,
-		}
-		sessionFlavors = append(sessionFlavors, sessionFlavor)
+// Create inserts the session and its flavors. Nothing is stored if any insert
+// fails or the flavor percentages are incomplete (models.ErrMixPercentages).
+func (r *SessionRepository) Create(ctx context.Context, session *models.ShishaSession, flavors []models.CreateFlavorRequest) (*models.SessionWithFlavors, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO shisha_sessions (id, user_id, created_by, session_date, store_name, notes, order_details, mix_name,
+			bowl_weight_grams, ` + ratingColumns + `, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $16)
+		RETURNING ` + sessionColumns
+
+	created, err := scanSession(tx.QueryRowContext(ctx, query, uuid.New().String(), session.UserID, session.CreatedBy,
+		session.SessionDate, session.StoreName, session.Notes, session.OrderDetails, session.MixName,
+		session.BowlWeightGrams, session.Rating, session.TasteRating, session.SmokeVolumeRating,
+		session.HarshnessRating, session.HeatStabilityRating, session.LongevityRating, time.Now()))
+	if err != nil {
+		return nil, err
 	}
 
-	if len(sessionFlavors) > 0 {
-		_, _, err = r.client.From("session_flavors").
-			Insert(sessionFlavors, false, "", "", "").
-			Execute()
+	createdFlavors, err := insertFlavors(ctx, tx, created.ID, flavors)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPercentages(ctx, tx, created.ID); err != nil {
+		return nil, err
+	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	computeGrams(createdFlavors, created.BowlWeightGrams)
+	return &models.SessionWithFlavors{
+		ShishaSession: *created,
+		Flavors:       createdFlavors,
+	}, nil
+}
+
+// insertFlavors adds flavors to a session that has none inside tx, in the given
+// order
+func insertFlavors(ctx context.Context, tx *sql.Tx, sessionID string, flavors []models.CreateFlavorRequest) ([]models.SessionFlavor, error) {
+	created := []models.SessionFlavor{}
+	for i, flavor := range flavors {
+		inserted, err := insertFlavor(ctx, tx, sessionID, flavor, i)
 		if err != nil {
-			// Ideally should rollback session creation, but Supabase doesn't support transactions via REST API
 			return nil, err
 		}
+		created = append(created, *inserted)
 	}
 
+	return created, nil
+}
+
+func insertFlavor(ctx context.Context, tx *sql.Tx, sessionID string, flavor models.CreateFlavorRequest, position int) (*models.SessionFlavor, error) {
+	query := `
+		INSERT INTO session_flavors (id, session_id, flavor_name, brand, position, percentage, grams, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING ` + flavorColumns
+
+	return scanFlavor(tx.QueryRowContext(ctx, query, uuid.New().String(), sessionID, flavor.FlavorName, flavor.Brand,
+		position, flavor.Percentage, flavor.Grams, time.Now()))
+}
+
+// computeGrams fills in the computed grams of a session's flavors
+func computeGrams(flavors []models.SessionFlavor, bowlWeightGrams *float64) {
+	for i := range flavors {
+		flavors[i].ComputeGrams(bowlWeightGrams)
+	}
+}
+
+// GetByID returns the session with its flavors, or ErrSessionNotFound
+func (r *SessionRepository) GetByID(ctx context.Context, id string) (*models.SessionWithFlavors, error) {
+	query := `SELECT ` + sessionColumns + ` FROM shisha_sessions WHERE id = $1`
+
+	session, err := scanSession(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+
+	flavors, err := r.getFlavors(ctx, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	computeGrams(flavors[id], session.BowlWeightGrams)
+
 	return &models.SessionWithFlavors{
-		ShishaSession: createdSession,
-		Flavors:       sessionFlavors,
+		ShishaSession: *session,
+		Flavors:       flavors[id],
 	}, nil
 }
 
-func (r *SessionRepository) GetByID(ctx context.Context, id string) (*models.SessionWithFlavors, error) {
+// Search returns a page of the user's sessions matching the filter. Sessions
+// without the rating sorted by come last in either direction, ties go to the
+// latest session date. A limit of 0 returns every session.
+func (r *SessionRepository) Search(ctx context.Context, filter models.SessionFilter) ([]models.SessionWithFlavors, error) {
+	conditions := []string{"user_id = $1"}
+	args := []interface{}{filter.UserID}
+	where := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, strings.ReplaceAll(condition, "$?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	// Only known rating columns go into the query
+	for _, field := range models.SessionRatingFields {
+		if rating, ok := filter.MinRatings[field]; ok {
+			where(field+" >= $?", rating)
+		}
+		if rating, ok := filter.MaxRatings[field]; ok {
+			where(field+" <= $?", rating)
+		}
+	}
+
+	// The sort field is checked against the known columns before it goes into
+	// the query
+	sort := filter.Sort
+	if !models.IsValidSessionSort(sort) {
+		sort = models.SessionSortDate
+	}
+	direction := "DESC"
+	if filter.Ascending {
+		direction = "ASC"
+	}
+
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM shisha_sessions
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY ` + sort + ` ` + direction + ` NULLS LAST, session_date DESC, id`
+	args = append(args, filter.Offset)
+	query += fmt.Sprintf(`
+		OFFSET $%d`, len(args))
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(`
+		LIMIT $%d`, len(args))
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
 	var sessions []models.ShishaSession
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	data, _, err := r.client.From("shisha_sessions").
-		Select("*", "exact", false).
-		Eq("id", id).
-		Execute()
+	// Get flavors for all sessions
+	sessionIDs := make([]string, len(sessions))
+	for i, session := range sessions {
+		sessionIDs[i] = session.ID
+	}
 
+	flavors, err := r.getFlavors(ctx, sessionIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(data, &sessions)
+	result := make([]models.SessionWithFlavors, len(sessions))
+	for i, session := range sessions {
+		computeGrams(flavors[session.ID], session.BowlWeightGrams)
+		result[i] = models.SessionWithFlavors{
+			ShishaSession: session,
+			Flavors:       flavors[session.ID],
+		}
+	}
+
+	return result, nil
+}
+
+// getFlavors returns the flavors of the sessions in order, keyed by session ID
+func (r *SessionRepository) getFlavors(ctx context.Context, sessionIDs []string) (map[string][]models.SessionFlavor, error) {
+	flavors := make(map[string][]models.SessionFlavor)
+	for _, id := range sessionIDs {
+		flavors[id] = []models.SessionFlavor{}
+	}
+	if len(sessionIDs) == 0 {
+		return flavors, nil
+	}
+
+	query := `
+		SELECT ` + flavorColumns + `
+		FROM session_flavors
+		WHERE session_id = ANY($1)
+		ORDER BY session_id, position
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(sessionIDs))
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if len(sessions) == 0 {
-		return nil, errors.New("session not found")
+	for rows.Next() {
+		flavor, err := scanFlavor(rows)
+		if err != nil {
+			return nil, err
+		}
+		flavors[flavor.SessionID] = append(flavors[flavor.SessionID], *flavor)
 	}
 
-	session := sessions[0]
+	return flavors, rows.Err()
+}
+
+// CountByUserID returns the number of sessions the user owns
+func (r *SessionRepository) CountByUserID(ctx context.Context, userID string) (int64, error) {
+	var count int64
+	query := `SELECT COUNT(*) FROM shisha_sessions WHERE user_id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
 
-	// Get flavors
-	var flavors []models.SessionFlavor
-	data, _, err = r.client.From("session_flavors").
-		Select("*", "exact", false).
-		Eq("session_id", id).
-		Execute()
+// Live session methods. A session runs from started_at until ended_at is set;
+// a unique index allows only one running session per user.
 
+// GetActive returns the user's running session, or ErrSessionNotFound
+func (r *SessionRepository) GetActive(ctx context.Context, userID string) (*models.SessionWithFlavors, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM shisha_sessions
+		WHERE user_id = $1 AND started_at IS NOT NULL AND ended_at IS NULL
+	`
+
+	session, err := scanSession(r.db.QueryRowContext(ctx, query, userID))
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
 		return nil, err
 	}
 
-	err = json.Unmarshal(data, &flavors)
+	flavors, err := r.getFlavors(ctx, []string{session.ID})
 	if err != nil {
 		return nil, err
 	}
+	computeGrams(flavors[session.ID], session.BowlWeightGrams)
 
 	return &models.SessionWithFlavors{
-		ShishaSession: session,
-		Flavors:       flavors,
+		ShishaSession: *session,
+		Flavors:       flavors[session.ID],
 	}, nil
 }
 
-func (r *SessionRepository) GetByUserID(ctx context.Context, userID string, limit, offset int) ([]models.SessionWithFlavors, error) {
-	var sessions []models.ShishaSession
+// Start starts the session at startedAt. A session can only be started once;
+// it returns ErrSessionStarted if it was, and ErrOtherSessionRunning if the
+// owner has another session running.
+func (r *SessionRepository) Start(ctx context.Context, id string, startedAt time.Time) error {
+	query := `
+		UPDATE shisha_sessions
+		SET started_at = $2, updated_at = $2
+		WHERE id = $1 AND started_at IS NULL
+	`
+
+	result, err := r.db.ExecContext(ctx, query, id, startedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrOtherSessionRunning
+		}
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrSessionStarted
+		}
+		return err
+	}
+	return nil
+}
+
+// Stop ends the running session at endedAt, or at maxDuration after its start
+// if that is earlier, marking it as stopped automatically. It returns
+// ErrSessionNotRunning if the session isn't running.
+func (r *SessionRepository) Stop(ctx context.Context, id string, endedAt time.Time, maxDuration time.Duration) error {
+	query := `
+		UPDATE shisha_sessions
+		SET ended_at = LEAST($2::timestamptz, started_at + $3::float8 * INTERVAL '1 second'),
+			auto_stopped = $2::timestamptz > started_at + $3::float8 * INTERVAL '1 second', updated_at = $2
+		WHERE id = $1 AND started_at IS NOT NULL AND ended_at IS NULL
+	`
+
+	result, err := r.db.ExecContext(ctx, query, id, endedAt, maxDuration.Seconds())
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrSessionNotRunning
+		}
+		return err
+	}
+	return nil
+}
+
+// StopOverdue stops the sessions that have been running for longer than
+// maxDuration at maxDuration after their start. With a userID, only that user's
+// session is stopped. It returns the number of sessions stopped.
+func (r *SessionRepository) StopOverdue(ctx context.Context, userID string, maxDuration time.Duration) (int64, error) {
+	query := `
+		UPDATE shisha_sessions
+		SET ended_at = started_at + $2::float8 * INTERVAL '1 second', auto_stopped = true, updated_at = $1
+		WHERE started_at IS NOT NULL AND ended_at IS NULL
+			AND started_at < $1::timestamptz - $2::float8 * INTERVAL '1 second'
+			AND ($3::text = '' OR user_id = $3)
+	`
+
+	result, err := r.db.ExecContext(ctx, query, time.Now(), maxDuration.Seconds(), userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Rating statistics
+
+// ratingAverages selects the rounded average of every rating column
+const ratingAverages = `ROUND(AVG(rating), 2), ROUND(AVG(taste_rating), 2), ROUND(AVG(smoke_volume_rating), 2),
+		ROUND(AVG(harshness_rating), 2), ROUND(AVG(heat_stability_rating), 2), ROUND(AVG(longevity_rating), 2)`
+
+func ratingAverageDests(averages *models.RatingAverages) []interface{} {
+	return []interface{}{&averages.Rating, &averages.TasteRating, &averages.SmokeVolumeRating,
+		&averages.HarshnessRating, &averages.HeatStabilityRating, &averages.LongevityRating}
+}
+
+// FlavorStats summarizes the ratings of the user's sessions per flavor, best
+// rated first. A flavor counts once per session.
+func (r *SessionRepository) FlavorStats(ctx context.Context, userID string) ([]models.FlavorStats, error) {
+	query := `
+		WITH smoked AS (
+			SELECT DISTINCT ON (s.id, lower(f.flavor_name), lower(COALESCE(f.brand, '')))
+				lower(f.flavor_name) AS flavor_key, lower(COALESCE(f.brand, '')) AS brand_key,
+				f.flavor_name, f.brand, s.session_date, s.rating, s.taste_rating, s.smoke_volume_rating,
+				s.harshness_rating, s.heat_stability_rating, s.longevity_rating
+			FROM shisha_sessions s
+			JOIN session_flavors f ON f.session_id = s.id
+			WHERE s.user_id = $1
+			ORDER BY s.id, lower(f.flavor_name), lower(COALESCE(f.brand, ''))
+		)
+		SELECT (ARRAY_AGG(flavor_name ORDER BY session_date DESC))[1], (ARRAY_AGG(brand ORDER BY session_date DESC))[1],
+			COUNT(*), COUNT(rating), ` + ratingAverages + `
+		FROM smoked
+		GROUP BY flavor_key, brand_key
+		ORDER BY AVG(rating) DESC NULLS LAST, COUNT(*) DESC, flavor_key, brand_key
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []models.FlavorStats{}
+	for rows.Next() {
+		var flavor models.FlavorStats
+		dests := append([]interface{}{&flavor.FlavorName, &flavor.Brand, &flavor.SessionCount, &flavor.RatedCount},
+			ratingAverageDests(&flavor.AverageRatings)...)
+		if err := rows.Scan(dests...); err != nil {
+			return nil, err
+		}
+		stats = append(stats, flavor)
+	}
+
+	return stats, rows.Err()
+}
+
+// MixStats summarizes the ratings of the user's sessions per combination of
+// flavors, best rated first. Sessions without flavors are left out.
+func (r *SessionRepository) MixStats(ctx context.Context, userID string) ([]models.MixStats, error) {
+	query := `
+		WITH mixes AS (
+			SELECT s.id, s.session_date, s.mix_name, s.rating, s.taste_rating, s.smoke_volume_rating,
+				s.harshness_rating, s.heat_stability_rating, s.longevity_rating,
+				ARRAY_AGG(f.flavor_name ORDER BY f.position) AS flavors,
+				STRING_AGG(DISTINCT lower(f.flavor_name) || '|' || lower(COALESCE(f.brand, '')), ','
+					ORDER BY lower(f.flavor_name) || '|' || lower(COALESCE(f.brand, ''))) AS mix_key
+			FROM shisha_sessions s
+			JOIN session_flavors f ON f.session_id = s.id
+			WHERE s.user_id = $1
+			GROUP BY s.id
+		),
+		latest AS (
+			SELECT DISTINCT ON (mix_key) mix_key, flavors
+			FROM mixes
+			ORDER BY mix_key, session_date DESC
+		)
+		SELECT latest.flavors, (ARRAY_AGG(mixes.mix_name ORDER BY mixes.session_date DESC)
+				FILTER (WHERE mixes.mix_name IS NOT NULL))[1],
+			COUNT(*), COUNT(rating), ` + ratingAverages + `
+		FROM mixes
+		JOIN latest ON latest.mix_key = mixes.mix_key
+		GROUP BY mixes.mix_key, latest.flavors
+		ORDER BY AVG(rating) DESC NULLS LAST, COUNT(*) DESC, mixes.mix_key
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []models.MixStats{}
+	for rows.Next() {
+		var mix models.MixStats
+		dests := append([]interface{}{pq.Array(&mix.Flavors), &mix.MixName, &mix.SessionCount, &mix.RatedCount},
+			ratingAverageDests(&mix.AverageRatings)...)
+		if err := rows.Scan(dests...); err != nil {
+			return nil, err
+		}
+		stats = append(stats, mix)
+	}
+
+	return stats, rows.Err()
+}
+
+// Update changes the fields set in update and leaves the others alone. If
+// update.Flavors is set, the session's flavors are replaced by it, checking
+// their percentages as in Create.
+func (r *SessionRepository) Update(ctx context.Context, id string, update *models.UpdateSessionRequest) error {
+	var assignments []string
+	args := []interface{}{id}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if update.SessionDate != nil {
+		set("session_date", *update.SessionDate)
+	}
+	if update.StoreName != nil {
+		set("store_name", *update.StoreName)
+	}
+	if update.Notes != nil {
+		set("notes", *update.Notes)
+	}
+	if update.OrderDetails != nil {
+		set("order_details", *update.OrderDetails)
+	}
+	if update.MixName != nil {
+		set("mix_name", *update.MixName)
+	}
+	if update.BowlWeightGrams != nil {
+		set("bowl_weight_grams", nullIfZero(*update.BowlWeightGrams))
+	}
+	for column, rating := range map[string]*int{
+		"rating":                update.Rating,
+		"taste_rating":          update.TasteRating,
+		"smoke_volume_rating":   update.SmokeVolumeRating,
+		"harshness_rating":      update.HarshnessRating,
+		"heat_stability_rating": update.HeatStabilityRating,
+		"longevity_rating":      update.LongevityRating,
+	} {
+		if rating != nil {
+			set(column, nullIfZero(*rating))
+		}
+	}
 
-	query := r.client.From("shisha_sessions").
-		Select("*", "exact", false).
-		Eq("user_id", userID).
-		Order("session_date", nil) // nil uses default options (descending)
+	if len(assignments) == 0 && update.Flavors == nil {
+		return nil
+	}
+	set("updated_at", time.Now())
 
-	if limit > 0 {
-		query = query.Limit(limit, "")
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	if offset > 0 {
-		query = query.Range(offset, offset+limit-1, "")
+	query := `UPDATE shisha_sessions SET ` + strings.Join(assignments, ", ") + ` WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
 	}
 
-	data, _, err := query.Execute()
+	if update.Flavors != nil {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM session_flavors WHERE session_id = $1`, id); err != nil {
+			return err
+		}
+		if _, err := insertFlavors(ctx, tx, id, *update.Flavors); err != nil {
+			return err
+		}
+		if err := checkPercentages(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Flavor methods. Each one locks the session, so concurrent edits of the same
+// flavor list are applied one after the other and positions stay 0, 1, 2, ...
+// Percentages of the other flavors are scaled to keep the mix at 100%. They
+// return models.ErrMixPercentages if the mix still ends up with percentages on
+// only some flavors or not adding up to 100, and ErrFlavorNotFound for unknown
+// flavor IDs, including those in Percentages.
+
+// AddFlavor inserts a flavor at flavor.Position, moving the flavors from there
+// on back by one. Without a position, or with one past the end, the flavor is
+// added at the end.
+func (r *SessionRepository) AddFlavor(ctx context.Context, sessionID string, flavor *models.AddFlavorRequest) (*models.SessionFlavor, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	err = json.Unmarshal(data, &sessions)
+	bowlWeightGrams, err := touchSession(ctx, tx, sessionID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get flavors for all sessions
-	sessionIDs := make([]string, len(sessions))
-	for i, session := range sessions {
-		sessionIDs[i] = session.ID
+	count, err := countFlavors(ctx, tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	position := count
+	if flavor.Position != nil && *flavor.Position < count {
+		position = *flavor.Position
 	}
 
-	var allFlavors []models.SessionFlavor
-	if len(sessionIDs) > 0 {
-		data, _, err := r.client.From("session_flavors").
-			Select("*", "exact", false).
-			In("session_id", sessionIDs).
-			Execute()
+	query := `UPDATE session_flavors SET position = position + 1 WHERE session_id = $1 AND position >= $2`
+	if _, err := tx.ExecContext(ctx, query, sessionID, position); err != nil {
+		return nil, err
+	}
 
-		if err != nil {
+	created, err := insertFlavor(ctx, tx, sessionID, models.CreateFlavorRequest{
+		FlavorName: flavor.FlavorName,
+		Brand:      flavor.Brand,
+		Percentage: flavor.Percentage,
+		Grams:      flavor.Grams,
+	}, position)
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := make(map[string]float64)
+	for id, percentage := range flavor.Percentages {
+		fixed[id] = percentage
+	}
+	if flavor.Percentage != nil {
+		fixed[created.ID] = *flavor.Percentage
+	}
+	if len(fixed) > 0 {
+		if err := rebalancePercentages(ctx, tx, sessionID, fixed); err != nil {
 			return nil, err
 		}
+	}
+
+	if err := checkPercentages(ctx, tx, sessionID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	created.ComputeGrams(bowlWeightGrams)
+	return created, nil
+}
+
+// UpdateFlavor changes the fields set in update. A new position past the end
+// moves the flavor to the end. It returns ErrFlavorNotFound if the flavor
+// doesn't belong to the session.
+func (r *SessionRepository) UpdateFlavor(ctx context.Context, sessionID, flavorID string, update *models.UpdateFlavorRequest) (*models.SessionFlavor, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bowlWeightGrams, err := touchSession(ctx, tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var current int
+	query := `SELECT position FROM session_flavors WHERE id = $1 AND session_id = $2`
+	if err := tx.QueryRowContext(ctx, query, flavorID, sessionID).Scan(&current); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrFlavorNotFound
+		}
+		return nil, err
+	}
 
-		err = json.Unmarshal(data, &allFlavors)
+	position := current
+	if update.Position != nil {
+		count, err := countFlavors(ctx, tx, sessionID)
 		if err != nil {
 			return nil, err
 		}
+		position = min(*update.Position, count-1)
 	}
 
-	// Map flavors to sessions
-	flavorMap := make(map[string][]models.SessionFlavor)
-	for _, flavor := range allFlavors {
-		flavorMap[flavor.SessionID] = append(flavorMap[flavor.SessionID], flavor)
+	// Close the gap left behind and open one at the new position
+	switch {
+	case position < current:
+		query = `UPDATE session_flavors SET position = position + 1 WHERE session_id = $1 AND position >= $2 AND position < $3`
+		_, err = tx.ExecContext(ctx, query, sessionID, position, current)
+	case position > current:
+		query = `UPDATE session_flavors SET position = position - 1 WHERE session_id = $1 AND position > $3 AND position <= $2`
+		_, err = tx.ExecContext(ctx, query, sessionID, position, current)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	result := make([]models.SessionWithFlavors, len(sessions))
-	for i, session := range sessions {
-		result[i] = models.SessionWithFlavors{
-			ShishaSession: session,
-			Flavors:       flavorMap[session.ID],
+	assignments := []string{"position = $2"}
+	args := []interface{}{flavorID, position}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if update.FlavorName != nil {
+		set("flavor_name", *update.FlavorName)
+	}
+	if update.Brand != nil {
+		if *update.Brand == "" {
+			set("brand", nil)
+		} else {
+			set("brand", *update.Brand)
 		}
 	}
+	if update.Grams != nil {
+		set("grams", nullIfZero(*update.Grams))
+	}
 
-	return result, nil
-}
+	query = `UPDATE session_flavors SET ` + strings.Join(assignments, ", ") + ` WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
 
-func (r *SessionRepository) Update(ctx context.Context, id string, update *models.UpdateSessionRequest) error {
-	updateMap := make(map[string]interface{})
+	fixed := make(map[string]float64)
+	for id, percentage := range update.Percentages {
+		fixed[id] = percentage
+	}
+	if update.Percentage != nil {
+		if *update.Percentage == 0 {
+			// Without this flavor's share the mix has no proportions any more
+			if _, err := tx.ExecContext(ctx, `UPDATE session_flavors SET percentage = NULL WHERE session_id = $1`, sessionID); err != nil {
+				return nil, err
+			}
+			delete(fixed, flavorID)
+		} else {
+			fixed[flavorID] = *update.Percentage
+		}
+	}
+	if len(fixed) > 0 {
+		if err := rebalancePercentages(ctx, tx, sessionID, fixed); err != nil {
+			return nil, err
+		}
+	}
 
-	if update.SessionDate != nil {
-		updateMap["session_date"] = *update.SessionDate
+	if err := checkPercentages(ctx, tx, sessionID); err != nil {
+		return nil, err
 	}
-	if update.StoreName != nil {
-		updateMap["store_name"] = *update.StoreName
+
+	query = `SELECT ` + flavorColumns + ` FROM session_flavors WHERE id = $1`
+	flavor, err := scanFlavor(tx.QueryRowContext(ctx, query, flavorID))
+	if err != nil {
+		return nil, err
 	}
-	if update.Notes != nil {
-		updateMap["notes"] = *update.Notes
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-	if update.OrderDetails != nil {
-		updateMap["order_details"] = *update.OrderDetails
+
+	flavor.ComputeGrams(bowlWeightGrams)
+	return flavor, nil
+}
+
+// DeleteFlavor removes a flavor and moves the ones after it forward. The
+// remaining percentages are scaled up to 100. It returns ErrFlavorNotFound if
+// the flavor doesn't belong to the session.
+func (r *SessionRepository) DeleteFlavor(ctx context.Context, sessionID, flavorID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	if update.MixName != nil {
-		updateMap["mix_name"] = *update.MixName
+	defer tx.Rollback()
+
+	if _, err := touchSession(ctx, tx, sessionID); err != nil {
+		return err
 	}
 
-	if len(updateMap) == 0 {
-		return nil
+	var position int
+	query := `DELETE FROM session_flavors WHERE id = $1 AND session_id = $2 RETURNING position`
+	if err := tx.QueryRowContext(ctx, query, flavorID, sessionID).Scan(&position); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrFlavorNotFound
+		}
+		return err
 	}
 
-	_, _, err := r.client.From("shisha_sessions").
-		Update(updateMap, "", "").
-		Eq("id", id).
-		Execute()
+	query = `UPDATE session_flavors SET position = position - 1 WHERE session_id = $1 AND position > $2`
+	if _, err := tx.ExecContext(ctx, query, sessionID, position); err != nil {
+		return err
+	}
 
-	return err
+	if err := rebalancePercentages(ctx, tx, sessionID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (r *SessionRepository) Delete(ctx context.Context, id string) error {
-	// Delete flavors first
-	_, _, err := r.client.From("session_flavors").
-		Delete("", "").
-		Eq("session_id", id).
-		Execute()
+// touchSession bumps the session's updated_at, which also locks it until tx
+// ends, and returns its bowl weight. It returns ErrSessionNotFound if the
+// session does not exist.
+func touchSession(ctx context.Context, tx *sql.Tx, sessionID string) (*float64, error) {
+	var bowlWeightGrams sql.NullFloat64
+	query := `UPDATE shisha_sessions SET updated_at = $2 WHERE id = $1 RETURNING bowl_weight_grams`
+
+	if err := tx.QueryRowContext(ctx, query, sessionID, time.Now()).Scan(&bowlWeightGrams); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+
+	if !bowlWeightGrams.Valid {
+		return nil, nil
+	}
+	return &bowlWeightGrams.Float64, nil
+}
+
+// rebalancePercentages gives flavors the percentages in fixed, keyed by flavor
+// ID, and scales the percentages of the session's other flavors so the mix adds
+// up to 100 again. Flavors without a percentage are left alone.
+func rebalancePercentages(ctx context.Context, tx *sql.Tx, sessionID string, fixed map[string]float64) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, percentage FROM session_flavors WHERE session_id = $1 ORDER BY position`, sessionID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := 0
+	remaining := 100.0
+	var scaledIDs []string
+	var scaled []float64
+	for rows.Next() {
+		var id string
+		var percentage sql.NullFloat64
+		if err := rows.Scan(&id, &percentage); err != nil {
+			return err
+		}
+		if value, ok := fixed[id]; ok {
+			found++
+			remaining -= value
+		} else if percentage.Valid {
+			scaledIDs = append(scaledIDs, id)
+			scaled = append(scaled, percentage.Float64)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if found != len(fixed) {
+		return ErrFlavorNotFound
+	}
+	if len(scaled) > 0 {
+		if scaled, err = models.ScalePercentages(scaled, remaining); err != nil {
+			return err
+		}
+	}
+
+	query := `UPDATE session_flavors SET percentage = $2 WHERE id = $1`
+	for id, percentage := range fixed {
+		if _, err := tx.ExecContext(ctx, query, id, percentage); err != nil {
+			return err
+		}
+	}
+	for i, id := range scaledIDs {
+		if _, err := tx.ExecContext(ctx, query, id, scaled[i]); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+// checkPercentages checks the session's flavor percentages as they are stored in
+// tx, after rounding to two decimals
+func checkPercentages(ctx context.Context, tx *sql.Tx, sessionID string) error {
+	rows, err := tx.QueryContext(ctx, `SELECT percentage FROM session_flavors WHERE session_id = $1`, sessionID)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+
+	var percentages []*float64
+	for rows.Next() {
+		var percentage sql.NullFloat64
+		if err := rows.Scan(&percentage); err != nil {
+			return err
+		}
+		if percentage.Valid {
+			percentages = append(percentages, &percentage.Float64)
+		} else {
+			percentages = append(percentages, nil)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return models.CheckPercentages(percentages)
+}
 
-	// Delete session
-	_, _, err = r.client.From("shisha_sessions").
-		Delete("", "").
-		Eq("id", id).
-		Execute()
+// nullIfZero stores 0 as NULL, for values where 0 means "remove"
+func nullIfZero[T int | float64](value T) interface{} {
+	if value == 0 {
+		return nil
+	}
+	return value
+}
+
+func countFlavors(ctx context.Context, tx *sql.Tx, sessionID string) (int, error) {
+	var count int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM session_flavors WHERE session_id = $1`, sessionID).Scan(&count)
+	return count, err
+}
+
+// Delete removes the session together with its flavors and other child rows
+func (r *SessionRepository) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM shisha_sessions WHERE id = $1`, id)
+	return err
+}
 
+// DeleteByUserID removes every session owned by the user together with their
+// child rows
+func (r *SessionRepository) DeleteByUserID(ctx context.Context, userID string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM shisha_sessions WHERE user_id = $1`, userID)
 	return err
 }
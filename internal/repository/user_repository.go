@@ -2,6 +2,8 @@ package repository
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,123 +18,610 @@ func NewUserRepository(db *sql.DB) *UserRepository {
 	return &UserRepository{db: db}
 }
 
-func (r *UserRepository) Create(userID, passwordHash, displayName string) (*models.User, error) {
-	user := &models.User{
-		ID:           uuid.New(),
-		UserID:       userID,
-		PasswordHash: passwordHash,
-		DisplayName:  displayName,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+const userColumns = `id, user_id, password_hash, display_name, role, email, email_verified_at, token_version,
+		deletion_scheduled_for, user_id_changed_at, suspended_at, suspension_reason, password_reset_required,
+		created_at, updated_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*models.User, error) {
+	user := &models.User{}
+	var email sql.NullString
+	var emailVerifiedAt sql.NullTime
+	var deletionScheduledFor sql.NullTime
+	var userIDChangedAt sql.NullTime
+	var suspendedAt sql.NullTime
+	var suspensionReason sql.NullString
+
+	err := row.Scan(&user.ID, &user.UserID, &user.PasswordHash, &user.DisplayName, &user.Role, &email, &emailVerifiedAt,
+		&user.TokenVersion, &deletionScheduledFor, &userIDChangedAt, &suspendedAt, &suspensionReason,
+		&user.PasswordResetRequired, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if email.Valid {
+		user.Email = &email.String
+	}
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+	if deletionScheduledFor.Valid {
+		user.DeletionScheduledFor = &deletionScheduledFor.Time
+	}
+	if userIDChangedAt.Valid {
+		user.UserIDChangedAt = &userIDChangedAt.Time
+	}
+	if suspendedAt.Valid {
+		user.SuspendedAt = &suspendedAt.Time
+	}
+	if suspensionReason.Valid {
+		user.SuspensionReason = &suspensionReason.String
 	}
 
+	return user, nil
+}
+
+// Create inserts a new user. It returns ErrDuplicate if the user ID is taken or
+// held for someone else.
+func (r *UserRepository) Create(userID, passwordHash, displayName string) (*models.User, error) {
 	query := `
 		INSERT INTO users (id, user_id, password_hash, display_name, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, user_id, password_hash, display_name, created_at, updated_at
+		VALUES ($1, $2, $3, $4, $5, $5)
+		RETURNING ` + userColumns
+
+	user, err := scanUser(r.db.QueryRow(query, uuid.New(), userID, passwordHash, displayName, time.Now()))
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicate
+	}
+	return user, err
+}
+
+func (r *UserRepository) GetByID(id uuid.UUID) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(r.db.QueryRow(query, id))
+}
+
+// GetByUserID looks a user up by user ID, ignoring case and character width
+func (r *UserRepository) GetByUserID(userID string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE user_id_normalized = lower(normalize($1, NFKC))`
+	return scanUser(r.db.QueryRow(query, userID))
+}
+
+// GetByPreviousUserID returns the user who changed away from userID, as long as
+// it is still held for them
+func (r *UserRepository) GetByPreviousUserID(userID string) (*models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = (
+			SELECT user_id FROM user_id_history
+			WHERE previous_user_id_normalized = lower(normalize($1, NFKC)) AND held_until > NOW()
+			ORDER BY created_at DESC
+			LIMIT 1
+		)
 	`
+	return scanUser(r.db.QueryRow(query, userID))
+}
 
-	err := r.db.QueryRow(query, user.ID, user.UserID, user.PasswordHash, user.DisplayName, user.CreatedAt, user.UpdatedAt).
-		Scan(&user.ID, &user.UserID, &user.PasswordHash, &user.DisplayName, &user.CreatedAt, &user.UpdatedAt)
+func (r *UserRepository) UpdateDisplayName(id uuid.UUID, displayName string) (*models.User, error) {
+	query := `
+		UPDATE users
+		SET display_name = $2, updated_at = $3
+		WHERE id = $1
+		RETURNING ` + userColumns
+
+	return scanUser(r.db.QueryRow(query, id, displayName, time.Now()))
+}
+
+// ChangeUserID renames the user and holds the old user ID for them until
+// heldUntil. Changing back to a user ID held for the same user releases the
+// hold. It returns sql.ErrNoRows if the user ID was last changed after
+// changedBefore and ErrDuplicate if the new one is taken or held for someone else.
+func (r *UserRepository) ChangeUserID(id uuid.UUID, userID string, changedBefore, heldUntil time.Time) (*models.User, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
+
+	var previous, previousNormalized string
+	query := `SELECT user_id, user_id_normalized FROM users WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRow(query, id).Scan(&previous, &previousNormalized); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	query = `
+		UPDATE users
+		SET user_id = $2, user_id_changed_at = $3, updated_at = $3
+		WHERE id = $1 AND (user_id_changed_at IS NULL OR user_id_changed_at <= $4)
+		RETURNING ` + userColumns
+
+	user, err := scanUser(tx.QueryRow(query, id, userID, now, changedBefore))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicate
+		}
+		return nil, err
+	}
+
+	query = `
+		DELETE FROM user_id_history
+		WHERE user_id = $1 AND previous_user_id_normalized = (SELECT user_id_normalized FROM users WHERE id = $1)
+	`
+	if _, err := tx.Exec(query, id); err != nil {
+		return nil, err
+	}
+
+	// A change of case or width keeps the same user ID, there is nothing to hold
+	query = `
+		INSERT INTO user_id_history (id, user_id, previous_user_id, previous_user_id_normalized, held_until, created_at)
+		SELECT $1::uuid, $2::uuid, $3::text, $4::text, $5::timestamptz, $6::timestamptz
+		WHERE $4::text <> (SELECT user_id_normalized FROM users WHERE id = $2)
+	`
+	if _, err := tx.Exec(query, uuid.New(), id, previous, previousNormalized, heldUntil, now); err != nil {
+		return nil, err
+	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return user, nil
 }
 
-func (r *UserRepository) GetByID(id uuid.UUID) (*models.User, error) {
-	user := &models.User{}
+// UpdatePassword sets a new password hash and bumps the token version so every
+// access token issued under the old password stops being accepted. It also
+// satisfies a password reset required by an admin.
+func (r *UserRepository) UpdatePassword(userID uuid.UUID, passwordHash string) error {
 	query := `
-		SELECT id, user_id, password_hash, display_name, created_at, updated_at
-		FROM users
+		UPDATE users
+		SET password_hash = $2, password_reset_required = false, token_version = token_version + 1, updated_at = $3
 		WHERE id = $1
 	`
 
-	err := r.db.QueryRow(query, id).
-		Scan(&user.ID, &user.UserID, &user.PasswordHash, &user.DisplayName, &user.CreatedAt, &user.UpdatedAt)
+	_, err := r.db.Exec(query, userID, passwordHash, time.Now())
+	return err
+}
+
+// UpdatePasswordHash replaces the stored hash of the same password, e.g. after
+// upgrading it to a stronger algorithm. Issued tokens stay valid, and nothing
+// changes if the password was changed since oldHash was read.
+func (r *UserRepository) UpdatePasswordHash(userID uuid.UUID, oldHash, newHash string) error {
+	query := `
+		UPDATE users
+		SET password_hash = $3
+		WHERE id = $1 AND password_hash = $2
+	`
+
+	_, err := r.db.Exec(query, userID, oldHash, newHash)
+	return err
+}
+
+// GetAuthStatus returns what decides whether the user's tokens are accepted
+func (r *UserRepository) GetAuthStatus(id uuid.UUID) (*models.UserAuthStatus, error) {
+	status := &models.UserAuthStatus{}
+	query := `SELECT token_version, role, suspended_at IS NOT NULL, deletion_scheduled_for IS NOT NULL FROM users WHERE id = $1`
+
+	err := r.db.QueryRow(query, id).Scan(&status.TokenVersion, &status.Role, &status.Suspended, &status.DeletionScheduled)
 	if err != nil {
 		return nil, err
 	}
+	return status, nil
+}
 
-	return user, nil
+// Admin methods
+
+// Search returns a page of users matching the filter, newest first, and the
+// number of matching users
+func (r *UserRepository) Search(filter models.UserFilter) ([]models.User, int, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, strings.ReplaceAll(condition, "$?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	if filter.Query != "" {
+		pattern := "%" + likeEscaper.Replace(filter.Query) + "%"
+		where("(user_id ILIKE $? OR display_name ILIKE $? OR email ILIKE $?)", pattern)
+	}
+	if filter.Role != "" {
+		where("role = $?", filter.Role)
+	}
+	if filter.Suspended != nil {
+		where("(suspended_at IS NOT NULL) = $?", *filter.Suspended)
+	}
+
+	query := `
+		SELECT ` + userColumns + `, COUNT(*) OVER ()
+		FROM users`
+	if len(conditions) > 0 {
+		query += `
+		WHERE ` + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	query += fmt.Sprintf(`
+		ORDER BY created_at DESC
+		LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	total := 0
+	for rows.Next() {
+		user, err := scanUser(countingRow{rows, &total})
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *user)
+	}
+
+	return users, total, rows.Err()
 }
 
-func (r *UserRepository) GetByUserID(userID string) (*models.User, error) {
-	user := &models.User{}
+// likeEscaper makes user input match literally in a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// countingRow scans a user row followed by a COUNT(*) OVER () column
+type countingRow struct {
+	rows  *sql.Rows
+	total *int
+}
+
+func (r countingRow) Scan(dest ...interface{}) error {
+	return r.rows.Scan(append(dest, r.total)...)
+}
+
+// Suspend blocks the user from logging in and from using any token until
+// Unsuspend. Suspending again keeps the original time and admin. It returns
+// sql.ErrNoRows if the user does not exist.
+func (r *UserRepository) Suspend(id, suspendedBy uuid.UUID, reason *string) error {
 	query := `
-		SELECT id, user_id, password_hash, display_name, created_at, updated_at
-		FROM users
-		WHERE user_id = $1
+		UPDATE users
+		SET suspended_at = COALESCE(suspended_at, $3), suspended_by = COALESCE(suspended_by, $2),
+			suspension_reason = $4, updated_at = $3
+		WHERE id = $1
 	`
 
-	err := r.db.QueryRow(query, userID).
-		Scan(&user.ID, &user.UserID, &user.PasswordHash, &user.DisplayName, &user.CreatedAt, &user.UpdatedAt)
+	result, err := r.db.Exec(query, id, suspendedBy, time.Now(), reason)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return requireAffected(result)
+}
 
-	return user, nil
+// Unsuspend lifts a suspension, if any. It returns sql.ErrNoRows if the user
+// does not exist.
+func (r *UserRepository) Unsuspend(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET suspended_at = NULL, suspended_by = NULL, suspension_reason = NULL, updated_at = $2
+		WHERE id = $1
+	`
+
+	result, err := r.db.Exec(query, id, time.Now())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
 }
 
-func (r *UserRepository) Update(user *models.User) error {
+// RequirePasswordReset refuses password logins until the user sets a new
+// password, and bumps the token version so issued access tokens stop working.
+// It returns sql.ErrNoRows if the user does not exist.
+func (r *UserRepository) RequirePasswordReset(id uuid.UUID) error {
 	query := `
 		UPDATE users
-		SET user_id = $2, display_name = $3, updated_at = $4
+		SET password_reset_required = true, token_version = token_version + 1, updated_at = $2
 		WHERE id = $1
 	`
 
-	_, err := r.db.Exec(query, user.ID, user.UserID, user.DisplayName, time.Now())
-	return err
+	result, err := r.db.Exec(query, id, time.Now())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
 }
 
-func (r *UserRepository) UpdatePassword(userID uuid.UUID, passwordHash string) error {
+// Account deletion methods
+
+// ScheduleDeletion marks the account for purging at scheduledFor. Requesting
+// deletion again keeps the original schedule.
+func (r *UserRepository) ScheduleDeletion(id uuid.UUID, scheduledFor time.Time) (time.Time, error) {
 	query := `
 		UPDATE users
-		SET password_hash = $2, updated_at = $3
+		SET deletion_requested_at = COALESCE(deletion_requested_at, $2),
+			deletion_scheduled_for = COALESCE(deletion_scheduled_for, $3)
 		WHERE id = $1
+		RETURNING deletion_scheduled_for
 	`
 
-	_, err := r.db.Exec(query, userID, passwordHash, time.Now())
+	var scheduled time.Time
+	err := r.db.QueryRow(query, id, time.Now(), scheduledFor).Scan(&scheduled)
+	return scheduled, err
+}
+
+// CancelDeletion clears a pending deletion request. It returns sql.ErrNoRows if
+// there is none or the grace period is already over.
+func (r *UserRepository) CancelDeletion(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET deletion_requested_at = NULL, deletion_scheduled_for = NULL
+		WHERE id = $1 AND deletion_scheduled_for > NOW()
+	`
+
+	result, err := r.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// GetDueForDeletion returns the accounts whose grace period has ended
+func (r *UserRepository) GetDueForDeletion() ([]uuid.UUID, error) {
+	query := `SELECT id FROM users WHERE deletion_scheduled_for <= NOW() ORDER BY deletion_scheduled_for`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Delete removes the user row. Passkeys, tokens and other auth data cascade.
+// Deleting a user that no longer exists is not an error.
+func (r *UserRepository) Delete(id uuid.UUID) error {
+	_, err := r.db.Exec(`DELETE FROM users WHERE id = $1`, id)
 	return err
 }
 
 // Password Reset Token methods
 
-func (r *UserRepository) CreatePasswordResetToken(userID uuid.UUID, token string, expiresAt time.Time) error {
+// CreatePasswordResetToken stores the SHA-256 hash of a reset token. The token
+// itself is only ever sent to the user.
+func (r *UserRepository) CreatePasswordResetToken(userID uuid.UUID, tokenHash string, expiresAt time.Time) error {
 	query := `
-		INSERT INTO password_reset_tokens (id, user_id, token, expires_at, created_at)
+		INSERT INTO password_reset_tokens (id, user_id, token_hash, expires_at, created_at)
 		VALUES ($1, $2, $3, $4, $5)
 	`
 
-	_, err := r.db.Exec(query, uuid.New(), userID, token, expiresAt, time.Now())
+	_, err := r.db.Exec(query, uuid.New(), userID, tokenHash, expiresAt, time.Now())
 	return err
 }
 
-func (r *UserRepository) GetPasswordResetToken(token string) (*models.PasswordResetToken, error) {
-	resetToken := &models.PasswordResetToken{}
+// GetByPasswordResetToken returns the user an unused, unexpired reset token belongs to
+func (r *UserRepository) GetByPasswordResetToken(tokenHash string) (*models.User, error) {
 	query := `
-		SELECT id, user_id, token, expires_at, used, created_at
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = (
+			SELECT user_id FROM password_reset_tokens
+			WHERE token_hash = $1 AND used = false AND expires_at > NOW()
+		)
+	`
+	return scanUser(r.db.QueryRow(query, tokenHash))
+}
+
+// ConsumePasswordResetToken sets a new password using a reset token in a single
+// transaction, so a token can never be used twice. Every other outstanding reset
+// token for the user is invalidated as well. It returns sql.ErrNoRows for an
+// unknown, used or expired token.
+func (r *UserRepository) ConsumePasswordResetToken(tokenHash, passwordHash string) (uuid.UUID, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	query := `
+		SELECT user_id
 		FROM password_reset_tokens
-		WHERE token = $1 AND used = false AND expires_at > NOW()
+		WHERE token_hash = $1 AND used = false AND expires_at > NOW()
+		FOR UPDATE
+	`
+	if err := tx.QueryRow(query, tokenHash).Scan(&userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	query = `
+		UPDATE users
+		SET password_hash = $2, password_reset_required = false, token_version = token_version + 1, updated_at = $3
+		WHERE id = $1
+	`
+	if _, err := tx.Exec(query, userID, passwordHash, time.Now()); err != nil {
+		return uuid.Nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE password_reset_tokens SET used = true WHERE user_id = $1 AND used = false`, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, err
+	}
+	return userID, nil
+}
+
+// Email verification methods
+
+const emailVerificationTokenColumns = `id, request_id, user_id, email, purpose, token_hash, expires_at, used_at,
+		sent_at, created_at`
+
+func scanEmailVerificationToken(row interface{ Scan(...interface{}) error }) (*models.EmailVerificationToken, error) {
+	token := &models.EmailVerificationToken{}
+	err := row.Scan(&token.ID, &token.RequestID, &token.UserID, &token.Email, &token.Purpose, &token.TokenHash,
+		&token.ExpiresAt, &token.UsedAt, &token.SentAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// CreateEmailVerificationTokens stores the tokens of a new verification request,
+// replacing any earlier unfinished request so only the latest links work
+func (r *UserRepository) CreateEmailVerificationTokens(userID uuid.UUID, tokens []*models.EmailVerificationToken) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM email_verification_tokens
+		WHERE request_id IN (SELECT request_id FROM email_verification_tokens WHERE user_id = $1 AND used_at IS NULL)
+	`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return err
+	}
+
+	requestID := uuid.New()
+	now := time.Now()
+	query = `
+		INSERT INTO email_verification_tokens (id, request_id, user_id, email, purpose, token_hash, expires_at, sent_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+	`
+	for _, token := range tokens {
+		token.ID = uuid.New()
+		token.RequestID = requestID
+		token.UserID = userID
+		token.SentAt = now
+		token.CreatedAt = now
+		_, err := tx.Exec(query, token.ID, token.RequestID, token.UserID, token.Email, token.Purpose, token.TokenHash,
+			token.ExpiresAt, token.SentAt, token.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetPendingEmailVerification returns the unused, unexpired tokens of the user's
+// unfinished verification request
+func (r *UserRepository) GetPendingEmailVerification(userID uuid.UUID) ([]*models.EmailVerificationToken, error) {
+	query := `
+		SELECT ` + emailVerificationTokenColumns + `
+		FROM email_verification_tokens
+		WHERE user_id = $1 AND used_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at
 	`
 
-	err := r.db.QueryRow(query, token).
-		Scan(&resetToken.ID, &resetToken.UserID, &resetToken.Token, &resetToken.ExpiresAt, &resetToken.Used, &resetToken.CreatedAt)
+	rows, err := r.db.Query(query, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return resetToken, nil
+	var tokens []*models.EmailVerificationToken
+	for rows.Next() {
+		token, err := scanEmailVerificationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
 }
 
-func (r *UserRepository) MarkPasswordResetTokenUsed(token string) error {
+// ReplaceEmailVerificationToken swaps the hash of an unused token for a newly
+// sent one, so only the latest link for the address works
+func (r *UserRepository) ReplaceEmailVerificationToken(id uuid.UUID, tokenHash string, expiresAt time.Time) error {
 	query := `
-		UPDATE password_reset_tokens
-		SET used = true
-		WHERE token = $1
+		UPDATE email_verification_tokens
+		SET token_hash = $2, expires_at = $3, sent_at = $4
+		WHERE id = $1 AND used_at IS NULL
 	`
 
-	_, err := r.db.Exec(query, token)
-	return err
+	result, err := r.db.Exec(query, id, tokenHash, expiresAt, time.Now())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// VerifyEmail consumes a verification token. Once every token of its request is
+// used, the address is set on the user and completed is true. It returns
+// sql.ErrNoRows for an unknown, used or expired token and ErrDuplicate if
+// another account verified the address first.
+func (r *UserRepository) VerifyEmail(tokenHash string) (token *models.EmailVerificationToken, completed bool, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var requestID uuid.UUID
+	if err := tx.QueryRow(`SELECT request_id FROM email_verification_tokens WHERE token_hash = $1`, tokenHash).Scan(&requestID); err != nil {
+		return nil, false, err
+	}
+
+	// Lock the whole request so the last of two concurrent confirmations sees the other
+	query := `
+		SELECT ` + emailVerificationTokenColumns + `
+		FROM email_verification_tokens
+		WHERE request_id = $1
+		ORDER BY id
+		FOR UPDATE
+	`
+	rows, err := tx.Query(query, requestID)
+	if err != nil {
+		return nil, false, err
+	}
+	pending := 0
+	for rows.Next() {
+		t, err := scanEmailVerificationToken(rows)
+		if err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		if t.TokenHash == tokenHash {
+			token = t
+		} else if t.UsedAt == nil {
+			pending++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if token == nil || token.UsedAt != nil || !token.ExpiresAt.After(time.Now()) {
+		return nil, false, sql.ErrNoRows
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(`UPDATE email_verification_tokens SET used_at = $2 WHERE id = $1`, token.ID, now); err != nil {
+		return nil, false, err
+	}
+	token.UsedAt = &now
+
+	if pending == 0 {
+		_, err = tx.Exec(`UPDATE users SET email = $2, email_verified_at = $3, updated_at = $3 WHERE id = $1`, token.UserID, token.Email, now)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return nil, false, ErrDuplicate
+			}
+			return nil, false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return token, pending == 0, nil
 }
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+// AccountService deletes accounts across both data paths: app data written
+// through Supabase and the user row in Postgres. The user row is removed last,
+// so an interrupted purge leaves the deletion request in place to be retried.
+type AccountService struct {
+	userRepo     *repository.UserRepository
+	profileRepo  *repository.ProfileRepository
+	sessionRepo  *repository.SessionRepository
+	tokenService *TokenService
+	gracePeriod  time.Duration
+}
+
+func NewAccountService(
+	cfg *config.Config,
+	userRepo *repository.UserRepository,
+	profileRepo *repository.ProfileRepository,
+	sessionRepo *repository.SessionRepository,
+	tokenService *TokenService,
+) *AccountService {
+	return &AccountService{
+		userRepo:     userRepo,
+		profileRepo:  profileRepo,
+		sessionRepo:  sessionRepo,
+		tokenService: tokenService,
+		gracePeriod:  ParseDurationSetting(cfg.AccountDeletionGrace, 0),
+	}
+}
+
+// RequestDeletion schedules the account for deletion after the grace period,
+// signs it out everywhere and deletes its personal access tokens. Without a
+// grace period it is purged right away; if that fails the scheduled purge
+// retries it. It reports whether the account is already gone.
+func (s *AccountService) RequestDeletion(ctx context.Context, userID uuid.UUID) (time.Time, bool, error) {
+	scheduledFor, err := s.userRepo.ScheduleDeletion(userID, time.Now().Add(s.gracePeriod))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if err := s.tokenService.RevokeAll(userID); err != nil {
+		return time.Time{}, false, err
+	}
+
+	if scheduledFor.After(time.Now()) {
+		return scheduledFor, false, nil
+	}
+
+	if err := s.Purge(ctx, userID); err != nil {
+		return scheduledFor, false, err
+	}
+	return scheduledFor, true, nil
+}
+
+// CancelDeletion keeps the account if its grace period has not ended yet
+func (s *AccountService) CancelDeletion(userID uuid.UUID) error {
+	return s.userRepo.CancelDeletion(userID)
+}
+
+// Purge removes all of the user's data. Every step is idempotent.
+func (s *AccountService) Purge(ctx context.Context, userID uuid.UUID) error {
+	id := userID.String()
+
+	if err := s.sessionRepo.DeleteByUserID(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	if err := s.profileRepo.Delete(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete profile: %w", err)
+	}
+	if err := s.userRepo.Delete(userID); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeDue deletes every account whose grace period has ended. It is meant to
+// be run periodically and also retries purges that failed earlier.
+func (s *AccountService) PurgeDue(ctx context.Context) error {
+	userIDs, err := s.userRepo.GetDueForDeletion()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, userID := range userIDs {
+		if err := s.Purge(ctx, userID); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("user %s: %w", userID, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+const (
+	adminUserDefaultLimit = 50
+	adminUserMaxLimit     = 200
+)
+
+// UserDetails is what admins see about a single user
+type UserDetails struct {
+	User         *models.User    `json:"user"`
+	Profile      *models.Profile `json:"profile"` // nil if the user never created one
+	SessionCount int64           `json:"session_count"`
+	DeviceCount  int             `json:"device_count"` // devices currently signed in
+}
+
+// AdminService carries out user management for operators
+type AdminService struct {
+	userRepo            *repository.UserRepository
+	profileRepo         *repository.ProfileRepository
+	sessionRepo         *repository.SessionRepository
+	tokenService        *TokenService
+	notificationService *NotificationService
+}
+
+func NewAdminService(
+	userRepo *repository.UserRepository,
+	profileRepo *repository.ProfileRepository,
+	sessionRepo *repository.SessionRepository,
+	tokenService *TokenService,
+	notificationService *NotificationService,
+) *AdminService {
+	return &AdminService{
+		userRepo:            userRepo,
+		profileRepo:         profileRepo,
+		sessionRepo:         sessionRepo,
+		tokenService:        tokenService,
+		notificationService: notificationService,
+	}
+}
+
+// ListUsers returns a page of users matching the filter and the total number of
+// matches. The page size defaults to 50 and is capped at 200.
+func (s *AdminService) ListUsers(filter models.UserFilter) ([]models.User, int, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = adminUserDefaultLimit
+	}
+	if filter.Limit > adminUserMaxLimit {
+		filter.Limit = adminUserMaxLimit
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	return s.userRepo.Search(filter)
+}
+
+// GetUserDetails returns the user with their profile and activity counts
+func (s *AdminService) GetUserDetails(ctx context.Context, userID uuid.UUID) (*UserDetails, error) {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	details := &UserDetails{User: user}
+
+	// Profiles are optional, the repository reports a missing one as an error
+	if profile, err := s.profileRepo.GetByID(ctx, userID.String()); err == nil {
+		details.Profile = profile
+	}
+
+	if details.SessionCount, err = s.sessionRepo.CountByUserID(ctx, userID.String()); err != nil {
+		return nil, fmt.Errorf("failed to count sessions: %w", err)
+	}
+
+	devices, err := s.tokenService.ListDevices(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	details.DeviceCount = len(devices)
+
+	return details, nil
+}
+
+// Suspend blocks the user and signs them out everywhere. Their personal access
+// tokens are rejected while the suspension lasts.
+func (s *AdminService) Suspend(userID, adminID uuid.UUID, reason string) error {
+	if err := s.userRepo.Suspend(userID, adminID, optionalString(reason)); err != nil {
+		return err
+	}
+	return s.tokenService.LogoutAll(userID)
+}
+
+// Unsuspend lets the user log in again
+func (s *AdminService) Unsuspend(userID uuid.UUID) error {
+	return s.userRepo.Unsuspend(userID)
+}
+
+// ForcePasswordReset refuses password logins until the user sets a new
+// password, signs them out everywhere and deletes their personal access tokens.
+// If the user has a verified address a reset link is sent to it; it reports
+// whether one was.
+func (s *AdminService) ForcePasswordReset(ctx context.Context, userID uuid.UUID) (bool, error) {
+	if err := s.userRepo.RequirePasswordReset(userID); err != nil {
+		return false, err
+	}
+	if err := s.tokenService.RevokeAll(userID); err != nil {
+		return false, err
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return false, err
+	}
+	if user.Email == nil || user.EmailVerifiedAt == nil {
+		return false, nil
+	}
+
+	resetToken, err := GenerateOpaqueToken()
+	if err != nil {
+		return false, err
+	}
+	if err := s.userRepo.CreatePasswordResetToken(userID, HashToken(resetToken), time.Now().Add(PasswordResetTTL)); err != nil {
+		return false, fmt.Errorf("failed to create reset token: %w", err)
+	}
+	if err := s.notificationService.SendPasswordReset(ctx, user, resetToken, PasswordResetTTL); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RevokeTokens signs the user out everywhere and deletes their personal access
+// tokens. It returns sql.ErrNoRows if the user does not exist.
+func (s *AdminService) RevokeTokens(userID uuid.UUID) error {
+	if _, err := s.userRepo.GetByID(userID); err != nil {
+		return err
+	}
+	return s.tokenService.RevokeAll(userID)
+}
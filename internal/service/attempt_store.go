@@ -0,0 +1,97 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+// AttemptStore keeps the counters used for brute-force protection and rate limiting
+type AttemptStore interface {
+	// Hit records an attempt for key, starting a new window once the current one is over
+	Hit(key string, window time.Duration) (*models.AuthAttempt, error)
+	// Get returns the record for key, or nil if its window is over
+	Get(key string) (*models.AuthAttempt, error)
+	// Reset forgets all attempts for key
+	Reset(key string) error
+}
+
+// MemoryAttemptStore keeps counters in process memory. Counters are per instance,
+// so use the Postgres store when running more than one.
+type MemoryAttemptStore struct {
+	mu        sync.Mutex
+	entries   map[string]*attemptEntry
+	lastPrune time.Time
+}
+
+type attemptEntry struct {
+	record    models.AuthAttempt
+	expiresAt time.Time
+}
+
+const attemptPruneInterval = time.Minute
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		entries:   make(map[string]*attemptEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+func (s *MemoryAttemptStore) Hit(key string, window time.Duration) (*models.AuthAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.pruneLocked(now)
+
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expiresAt) {
+		entry = &attemptEntry{
+			record:    models.AuthAttempt{WindowStart: now},
+			expiresAt: now.Add(window),
+		}
+		s.entries[key] = entry
+	}
+	entry.record.Count++
+	entry.record.LastAttempt = now
+
+	record := entry.record
+	return &record, nil
+}
+
+func (s *MemoryAttemptStore) Get(key string) (*models.AuthAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return nil, nil
+	}
+
+	record := entry.record
+	return &record, nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// pruneLocked drops counters whose window is over. The caller must hold s.mu.
+func (s *MemoryAttemptStore) pruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) < attemptPruneInterval {
+		return
+	}
+	s.lastPrune = now
+
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
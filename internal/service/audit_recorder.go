@@ -0,0 +1,61 @@
+package service
+
+import (
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+const (
+	auditDefaultLimit = 50
+	auditMaxLimit     = 200
+)
+
+// AuditRecorder writes security events to the append-only audit log
+type AuditRecorder struct {
+	auditRepo *repository.AuditRepository
+}
+
+func NewAuditRecorder(auditRepo *repository.AuditRepository) *AuditRecorder {
+	return &AuditRecorder{auditRepo: auditRepo}
+}
+
+// AuditEntry describes an event to record
+type AuditEntry struct {
+	EventType string
+	UserID    *uuid.UUID
+	ActorID   *uuid.UUID
+	Account   string // user ID as entered, for logins
+	Outcome   string
+	Reason    string
+	Client    ClientInfo
+}
+
+func (r *AuditRecorder) Record(entry AuditEntry) error {
+	return r.auditRepo.Create(&models.AuditEvent{
+		UserID:    entry.UserID,
+		ActorID:   entry.ActorID,
+		Account:   optionalString(entry.Account),
+		EventType: entry.EventType,
+		Outcome:   entry.Outcome,
+		Reason:    optionalString(entry.Reason),
+		IPAddress: optionalString(entry.Client.IPAddress),
+		UserAgent: optionalString(entry.Client.UserAgent),
+	})
+}
+
+// List returns events matching the filter, newest first. The page size defaults
+// to 50 and is capped at 200.
+func (r *AuditRecorder) List(filter models.AuditEventFilter) ([]models.AuditEvent, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = auditDefaultLimit
+	}
+	if filter.Limit > auditMaxLimit {
+		filter.Limit = auditMaxLimit
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	return r.auditRepo.List(filter)
+}
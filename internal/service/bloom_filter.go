@@ -0,0 +1,79 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// BloomFilter is a compact set membership test with false positives but no
+// false negatives. The binary form is a 4-byte hash count and 4-byte bit count,
+// both big endian, followed by the bits.
+type BloomFilter struct {
+	bits   []byte
+	m      uint32 // number of bits
+	hashes uint32
+}
+
+// NewBloomFilter sizes a filter for n entries at the given false positive rate
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	m := uint32(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &BloomFilter{
+		bits:   make([]byte, (m+7)/8),
+		m:      m,
+		hashes: hashes,
+	}
+}
+
+func (f *BloomFilter) Add(value string) {
+	h1, h2 := bloomHashes(value)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % uint64(f.m)
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Contains reports whether the value may have been added
+func (f *BloomFilter) Contains(value string) bool {
+	h1, h2 := bloomHashes(value)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % uint64(f.m)
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8, 8+len(f.bits))
+	binary.BigEndian.PutUint32(data[0:4], f.hashes)
+	binary.BigEndian.PutUint32(data[4:8], f.m)
+	return append(data, f.bits...), nil
+}
+
+func (f *BloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("bloom filter is too short")
+	}
+
+	hashes := binary.BigEndian.Uint32(data[0:4])
+	m := binary.BigEndian.Uint32(data[4:8])
+	if hashes == 0 || m == 0 || uint32(len(data)-8) != (m+7)/8 {
+		return errors.New("bloom filter header does not match its size")
+	}
+
+	f.hashes = hashes
+	f.m = m
+	f.bits = append([]byte(nil), data[8:]...)
+	return nil
+}
+
+// bloomHashes derives the two hashes combined into each probe (Kirsch-Mitzenmacher)
+func bloomHashes(value string) (uint64, uint64) {
+	sum := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// BruteForceGuard tracks failed logins per account and locks the account out for
+// progressively longer after too many failures. Failures count against the user
+// the typed user ID resolves to, so the current and previous user ID and their
+// Unicode variants share one counter. Unknown user IDs are counted by their
+// normalized form and throttled exactly like real ones.
+type BruteForceGuard struct {
+	store         AttemptStore
+	maxFailures   int
+	baseLockout   time.Duration
+	maxLockout    time.Duration
+	failureWindow time.Duration
+	resetLimit    int
+	resetWindow   time.Duration
+}
+
+func NewBruteForceGuard(cfg *config.Config, store AttemptStore) *BruteForceGuard {
+	return &BruteForceGuard{
+		store:         store,
+		maxFailures:   cfg.LoginMaxFailures,
+		baseLockout:   ParseDurationSetting(cfg.LoginLockoutBase, time.Minute),
+		maxLockout:    ParseDurationSetting(cfg.LoginLockoutMax, time.Hour),
+		failureWindow: 24 * time.Hour,
+		resetLimit:    3,
+		resetWindow:   time.Hour,
+	}
+}
+
+// CheckAccount returns how long the account is still locked out, or zero.
+// userID is the user the typed account resolved to, or nil if it is unknown.
+func (g *BruteForceGuard) CheckAccount(account string, userID *uuid.UUID) (time.Duration, error) {
+	record, err := g.store.Get(loginKey(account, userID))
+	if err != nil || record == nil {
+		return 0, err
+	}
+
+	return g.lockoutRemaining(record.Count, record.LastAttempt), nil
+}
+
+// RecordFailure counts a failed login and returns the resulting lockout, if any
+func (g *BruteForceGuard) RecordFailure(account string, userID *uuid.UUID) (time.Duration, error) {
+	record, err := g.store.Hit(loginKey(account, userID), g.failureWindow)
+	if err != nil {
+		return 0, err
+	}
+
+	return g.lockoutRemaining(record.Count, record.LastAttempt), nil
+}
+
+// RecordSuccess clears the failure count after a successful login
+func (g *BruteForceGuard) RecordSuccess(account string, userID *uuid.UUID) error {
+	return g.store.Reset(loginKey(account, userID))
+}
+
+// CheckPasswordReset counts a password reset request for the account and returns
+// how long to wait before another one is allowed, or zero
+func (g *BruteForceGuard) CheckPasswordReset(account string) (time.Duration, error) {
+	record, err := g.store.Hit("reset:"+normalizeAccount(account), g.resetWindow)
+	if err != nil {
+		return 0, err
+	}
+
+	if record.Count <= g.resetLimit {
+		return 0, nil
+	}
+	return time.Until(record.WindowStart.Add(g.resetWindow)), nil
+}
+
+// lockoutRemaining doubles the lockout for every failure past maxFailures
+func (g *BruteForceGuard) lockoutRemaining(failures int, lastFailure time.Time) time.Duration {
+	if failures < g.maxFailures {
+		return 0
+	}
+
+	lockout := time.Duration(float64(g.baseLockout) * math.Pow(2, float64(failures-g.maxFailures)))
+	if lockout > g.maxLockout || lockout <= 0 {
+		lockout = g.maxLockout
+	}
+
+	remaining := time.Until(lastFailure.Add(lockout))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func loginKey(account string, userID *uuid.UUID) string {
+	if userID != nil {
+		return "login:user:" + userID.String()
+	}
+	return "login:" + normalizeAccount(account)
+}
+
+// normalizeAccount folds a typed user ID the same way user_id_normalized does
+func normalizeAccount(account string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(account)))
+}
+
+// ParseDurationSetting parses a duration from the config, falling back to
+// defaultValue when it is invalid or not positive
+func ParseDurationSetting(value string, defaultValue time.Duration) time.Duration {
+	if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+		return parsed
+	}
+	return defaultValue
+}
@@ -0,0 +1,64 @@
+//go:build ignore
+
+// This program builds common_passwords.bloom from newline separated password
+// lists. Entries are lowercased, matching how PasswordService looks them up.
+//
+// The committed filter was built from the zxcvbn password frequency list:
+//
+//	go run gen_common_passwords.go -out common_passwords.bloom passwords.txt [more.txt ...]
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/toof-jp/shisha-log-backend/internal/service"
+)
+
+func main() {
+	out := flag.String("out", "common_passwords.bloom", "output file")
+	falsePositiveRate := flag.Float64("fp", 0.001, "false positive rate")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatal("usage: go run gen_common_passwords.go [-out file] [-fp rate] list.txt...")
+	}
+
+	seen := map[string]bool{}
+	for _, path := range flag.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			password := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if password != "" {
+				seen[password] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		file.Close()
+	}
+
+	filter := service.NewBloomFilter(len(seen), *falsePositiveRate)
+	for password := range seen {
+		filter.Add(password)
+	}
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote %d passwords to %s (%d bytes)", len(seen), *out, len(data))
+}
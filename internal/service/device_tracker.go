@@ -0,0 +1,134 @@
+package service
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+// deviceTouchInterval limits how often last-seen is written for one device
+const deviceTouchInterval = time.Minute
+
+// ClientInfo describes the client a login came from
+type ClientInfo struct {
+	UserAgent string
+	IPAddress string
+}
+
+// DeviceTracker checks that the device an access token was issued to is still
+// signed in and records when it was last seen. Writes are throttled per device
+// so busy clients don't update the row on every request.
+type DeviceTracker struct {
+	deviceRepo *repository.DeviceRepository
+	mu         sync.Mutex
+	lastTouch  map[uuid.UUID]time.Time
+	lastPrune  time.Time
+}
+
+func NewDeviceTracker(deviceRepo *repository.DeviceRepository) *DeviceTracker {
+	return &DeviceTracker{
+		deviceRepo: deviceRepo,
+		lastTouch:  make(map[uuid.UUID]time.Time),
+		lastPrune:  time.Now(),
+	}
+}
+
+// Seen reports whether the device is still signed in, updating its last-seen
+// time and IP address at most once per deviceTouchInterval
+func (t *DeviceTracker) Seen(deviceID uuid.UUID, ipAddress string) (bool, error) {
+	now := time.Now()
+
+	t.mu.Lock()
+	t.pruneLocked(now)
+	due := now.Sub(t.lastTouch[deviceID]) >= deviceTouchInterval
+	if due {
+		t.lastTouch[deviceID] = now
+	}
+	t.mu.Unlock()
+
+	if !due {
+		return t.deviceRepo.IsActive(deviceID)
+	}
+
+	if err := t.deviceRepo.Touch(deviceID, ipAddress, now); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// pruneLocked forgets devices that have not been seen for a while. The caller
+// must hold t.mu.
+func (t *DeviceTracker) pruneLocked(now time.Time) {
+	if now.Sub(t.lastPrune) < deviceTouchInterval {
+		return
+	}
+	t.lastPrune = now
+
+	for id, touched := range t.lastTouch {
+		if now.Sub(touched) >= deviceTouchInterval {
+			delete(t.lastTouch, id)
+		}
+	}
+}
+
+// DeviceLabel turns a User-Agent into a short description such as "Chrome on macOS"
+func DeviceLabel(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	browser := ""
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"), strings.Contains(userAgent, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	os := ""
+	switch {
+	case strings.Contains(userAgent, "iPhone"):
+		os = "iPhone"
+	case strings.Contains(userAgent, "iPad"):
+		os = "iPad"
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"), strings.Contains(userAgent, "Macintosh"):
+		os = "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	}
+
+	// Not a browser, e.g. a native app or a script. Use its product token.
+	product := strings.Fields(userAgent)[0]
+	if len(product) > 50 {
+		product = product[:50]
+	}
+	return product
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	emailResendInterval  = time.Minute
+)
+
+var (
+	ErrInvalidEmail               = errors.New("invalid email address")
+	ErrNoPendingEmailVerification = errors.New("no pending email verification")
+)
+
+// EmailResendTooSoonError is returned when verification links were sent less
+// than a minute ago
+type EmailResendTooSoonError struct {
+	Wait time.Duration
+}
+
+func (e *EmailResendTooSoonError) Error() string {
+	return fmt.Sprintf("verification email was sent recently, try again in %s", e.Wait.Round(time.Second))
+}
+
+// EmailService manages the user's contact address. Setting an address only
+// needs a link sent to it to be opened. Replacing a verified address also needs
+// a link sent to the current address, so whoever holds a session can't move
+// password resets to an address of their own.
+type EmailService struct {
+	userRepo            *repository.UserRepository
+	notificationService *NotificationService
+}
+
+func NewEmailService(userRepo *repository.UserRepository, notificationService *NotificationService) *EmailService {
+	return &EmailService{
+		userRepo:            userRepo,
+		notificationService: notificationService,
+	}
+}
+
+// ParseEmail accepts a bare address, not "Name <address>"
+func ParseEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != strings.TrimSpace(email) {
+		return "", ErrInvalidEmail
+	}
+	return address.Address, nil
+}
+
+// RequestChange starts verifying email as the user's new address and sends the
+// links. It reports whether the current address has to confirm the change too.
+// Like Resend, it refuses to send mail again within a minute of the pending
+// request's links.
+func (s *EmailService) RequestChange(ctx context.Context, user *models.User, email string) (bool, error) {
+	pending, err := s.userRepo.GetPendingEmailVerification(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if err := checkResendInterval(pending); err != nil {
+		return false, err
+	}
+
+	expiresAt := time.Now().Add(emailVerificationTTL)
+
+	verifyToken, err := GenerateOpaqueToken()
+	if err != nil {
+		return false, err
+	}
+	tokens := []*models.EmailVerificationToken{
+		{Email: email, Purpose: models.EmailTokenVerify, TokenHash: HashToken(verifyToken), ExpiresAt: expiresAt},
+	}
+
+	var approveToken string
+	if user.Email != nil && user.EmailVerifiedAt != nil {
+		if approveToken, err = GenerateOpaqueToken(); err != nil {
+			return false, err
+		}
+		tokens = append(tokens, &models.EmailVerificationToken{
+			Email: email, Purpose: models.EmailTokenApproveChange, TokenHash: HashToken(approveToken), ExpiresAt: expiresAt,
+		})
+	}
+
+	if err := s.userRepo.CreateEmailVerificationTokens(user.ID, tokens); err != nil {
+		return false, fmt.Errorf("failed to create verification token: %w", err)
+	}
+
+	if err := s.notificationService.SendEmailVerification(ctx, user, email, verifyToken, emailVerificationTTL); err != nil {
+		return false, err
+	}
+	if approveToken != "" {
+		if err := s.notificationService.SendEmailChangeApproval(ctx, user, email, approveToken, emailVerificationTTL); err != nil {
+			return false, err
+		}
+	}
+
+	return approveToken != "", nil
+}
+
+// Resend sends new links for the parts of the user's pending request that
+// haven't been confirmed yet. Links sent earlier stop working.
+func (s *EmailService) Resend(ctx context.Context, user *models.User) error {
+	tokens, err := s.userRepo.GetPendingEmailVerification(user.ID)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return ErrNoPendingEmailVerification
+	}
+
+	if err := checkResendInterval(tokens); err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(emailVerificationTTL)
+	for _, token := range tokens {
+		raw, err := GenerateOpaqueToken()
+		if err != nil {
+			return err
+		}
+		if err := s.userRepo.ReplaceEmailVerificationToken(token.ID, HashToken(raw), expiresAt); err != nil {
+			return fmt.Errorf("failed to replace verification token: %w", err)
+		}
+
+		switch token.Purpose {
+		case models.EmailTokenApproveChange:
+			err = s.notificationService.SendEmailChangeApproval(ctx, user, token.Email, raw, emailVerificationTTL)
+		default:
+			err = s.notificationService.SendEmailVerification(ctx, user, token.Email, raw, emailVerificationTTL)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkResendInterval returns an EmailResendTooSoonError if any of the tokens was
+// sent less than emailResendInterval ago
+func checkResendInterval(tokens []*models.EmailVerificationToken) error {
+	for _, token := range tokens {
+		if wait := time.Until(token.SentAt.Add(emailResendInterval)); wait > 0 {
+			return &EmailResendTooSoonError{Wait: wait}
+		}
+	}
+	return nil
+}
+
+// Confirm uses a token from a verification link. It reports whether the
+// address is now set, or still waits for the other address to confirm.
+func (s *EmailService) Confirm(token string) (*models.EmailVerificationToken, bool, error) {
+	return s.userRepo.VerifyEmail(HashToken(token))
+}
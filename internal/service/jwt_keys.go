@@ -0,0 +1,183 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWK is the public half of a signing key as published in the JWKS document
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+type verificationKey struct {
+	kid    string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+	jwk    JWK
+}
+
+// loadSigningKey reads a PEM encoded RSA or Ed25519 private key
+func loadSigningKey(path string) (*signingKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+
+	verification, err := newVerificationKey(private.Public())
+	if err != nil {
+		return nil, fmt.Errorf("unsupported signing key %s: %w", path, err)
+	}
+
+	return &signingKey{
+		kid:     verification.kid,
+		method:  verification.method,
+		private: private,
+	}, nil
+}
+
+// loadVerificationKey reads a PEM encoded public key, or a private key whose
+// public half should keep verifying tokens after it stops being used for signing
+func loadVerificationKey(path string) (*verificationKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var public crypto.PublicKey
+	if block.Type == "PUBLIC KEY" {
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	} else {
+		var private crypto.Signer
+		private, err = parsePrivateKey(block)
+		if err == nil {
+			public = private.Public()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse verification key %s: %w", path, err)
+	}
+
+	key, err := newVerificationKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported verification key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key cannot be used for signing")
+	}
+	return signer, nil
+}
+
+// newVerificationKey derives the algorithm, JWK and key ID for a public key. The
+// key ID is the RFC 7638 thumbprint, so it is stable across restarts and instances.
+func newVerificationKey(public crypto.PublicKey) (*verificationKey, error) {
+	var (
+		method     jwt.SigningMethod
+		jwk        JWK
+		thumbprint []byte
+		err        error
+	)
+
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+		jwk = JWK{
+			Kty: "RSA",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+		// Members must be in lexicographic order for the thumbprint
+		thumbprint, err = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N})
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+		jwk = JWK{
+			Kty: "OKP",
+			Alg: "EdDSA",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}
+		thumbprint, err = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X})
+	default:
+		return nil, fmt.Errorf("only RSA and Ed25519 keys are supported, got %T", public)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(thumbprint)
+	jwk.Kid = base64.RawURLEncoding.EncodeToString(sum[:])
+	jwk.Use = "sig"
+
+	return &verificationKey{
+		kid:    jwk.Kid,
+		method: method,
+		public: public,
+		jwk:    jwk,
+	}, nil
+}
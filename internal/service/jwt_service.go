@@ -1,6 +1,8 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -8,19 +10,39 @@ import (
 	"github.com/toof-jp/shisha-log-backend/internal/config"
 )
 
+const (
+	mfaTokenPurpose  = "mfa"
+	mfaTokenDuration = 5 * time.Minute
+)
+
+var ErrInvalidMFAToken = errors.New("invalid or expired MFA token")
+
+// JWTService signs access tokens with the configured RSA or Ed25519 key and
+// verifies them against every configured key, so keys can be rotated without
+// invalidating tokens signed by the previous one. Without a signing key it falls
+// back to HS256 with JWT_SECRET. Once a signing key is set, HS256 tokens are only
+// accepted while JWT_ACCEPT_HS256 is set for the transition, since JWT_SECRET
+// also serves other purposes such as encrypting TOTP secrets.
 type JWTService struct {
-	jwtSecret     string
-	tokenDuration time.Duration
+	jwtSecret        string
+	acceptHS256      bool
+	signingKey       *signingKey
+	verificationKeys map[string]*verificationKey
+	tokenDuration    time.Duration
 }
 
 type Claims struct {
-	UserID   uuid.UUID `json:"user_id"`
-	Username string    `json:"username"`
+	UserID       uuid.UUID `json:"user_id"`
+	Username     string    `json:"username"`
+	Role         string    `json:"role,omitempty"`    // models.RoleUser when missing from older tokens
+	TokenVersion int       `json:"token_version"`     // Must match users.token_version for the token to be accepted
+	SessionID    string    `json:"sid,omitempty"`     // Signed-in device, see models.AuthDevice
+	Purpose      string    `json:"purpose,omitempty"` // Set on restricted tokens such as MFA challenges
 	jwt.RegisteredClaims
 }
 
-func NewJWTService(cfg *config.Config) *JWTService {
-	duration := 24 * time.Hour // Default 24 hours
+func NewJWTService(cfg *config.Config) (*JWTService, error) {
+	duration := 15 * time.Minute // Default 15 minutes
 	if cfg.TokenDuration != "" {
 		parsed, err := time.ParseDuration(cfg.TokenDuration)
 		if err == nil {
@@ -28,40 +50,121 @@ func NewJWTService(cfg *config.Config) *JWTService {
 		}
 	}
 
-	return &JWTService{
-		jwtSecret:     cfg.JWTSecret,
-		tokenDuration: duration,
+	s := &JWTService{
+		jwtSecret:        cfg.JWTSecret,
+		verificationKeys: make(map[string]*verificationKey),
+		tokenDuration:    duration,
+	}
+
+	if cfg.JWTSigningKeyFile != "" {
+		key, err := loadSigningKey(cfg.JWTSigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.signingKey = key
+
+		public, err := newVerificationKey(key.private.Public())
+		if err != nil {
+			return nil, err
+		}
+		s.verificationKeys[public.kid] = public
 	}
+
+	for _, path := range cfg.JWTVerificationKeyFiles {
+		key, err := loadVerificationKey(path)
+		if err != nil {
+			return nil, err
+		}
+		s.verificationKeys[key.kid] = key
+	}
+
+	if s.signingKey == nil && s.jwtSecret == "" {
+		return nil, fmt.Errorf("either JWT_SIGNING_KEY_FILE or JWT_SECRET must be set")
+	}
+	s.acceptHS256 = s.jwtSecret != "" && (s.signingKey == nil || cfg.JWTAcceptHS256)
+
+	return s, nil
 }
 
-func (s *JWTService) GenerateToken(userID string) (string, error) {
+func (s *JWTService) GenerateToken(userID, role string, tokenVersion int, sessionID string) (string, error) {
 	uid, err := uuid.Parse(userID)
 	if err != nil {
 		return "", err
 	}
 
 	claims := &Claims{
-		UserID:   uid,
-		Username: "", // Kept for backward compatibility, can be removed in future
+		UserID:       uid,
+		Username:     "", // Kept for backward compatibility, can be removed in future
+		Role:         role,
+		TokenVersion: tokenVersion,
+		SessionID:    sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.tokenDuration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   userID,
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.jwtSecret))
+	return s.sign(claims)
+}
+
+// TokenDuration returns the lifetime of access tokens
+func (s *JWTService) TokenDuration() time.Duration {
+	return s.tokenDuration
+}
+
+// GenerateMFAToken issues a short-lived token proving the password step of a
+// login succeeded. It cannot be used as an access token.
+func (s *JWTService) GenerateMFAToken(userID string, tokenVersion int) (string, error) {
+	claims := &Claims{
+		TokenVersion: tokenVersion,
+		Purpose:      mfaTokenPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTokenDuration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   userID,
+		},
+	}
+
+	return s.sign(claims)
+}
+
+// ValidateMFAToken checks a token issued by GenerateMFAToken
+func (s *JWTService) ValidateMFAToken(tokenString string) (*Claims, error) {
+	claims, err := s.parse(tokenString)
+	if err != nil || claims.Purpose != mfaTokenPurpose {
+		return nil, ErrInvalidMFAToken
+	}
+	return claims, nil
 }
 
 func (s *JWTService) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return []byte(s.jwtSecret), nil
-	})
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restricted tokens must never be accepted as access tokens
+	if claims.Purpose != "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
 
+	return claims, nil
+}
+
+// PublicKeys returns the JWKs of every key tokens may be signed with
+func (s *JWTService) PublicKeys() []JWK {
+	keys := make([]JWK, 0, len(s.verificationKeys))
+	for _, key := range s.verificationKeys {
+		keys = append(keys, key.jwk)
+	}
+	return keys
+}
+
+func (s *JWTService) parse(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, s.keyFunc, jwt.WithValidMethods(s.validMethods()))
 	if err != nil {
 		return nil, err
 	}
@@ -72,3 +175,41 @@ func (s *JWTService) ValidateToken(tokenString string) (*Claims, error) {
 
 	return nil, jwt.ErrSignatureInvalid
 }
+
+func (s *JWTService) sign(claims jwt.Claims) (string, error) {
+	if s.signingKey == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(s.jwtSecret))
+	}
+
+	token := jwt.NewWithClaims(s.signingKey.method, claims)
+	token.Header["kid"] = s.signingKey.kid
+	return token.SignedString(s.signingKey.private)
+}
+
+func (s *JWTService) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if !s.acceptHS256 {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(s.jwtSecret), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := s.verificationKeys[kid]
+	if !ok || key.method.Alg() != token.Method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.public, nil
+}
+
+func (s *JWTService) validMethods() []string {
+	methods := []string{}
+	if s.acceptHS256 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if len(s.verificationKeys) > 0 {
+		methods = append(methods, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg())
+	}
+	return methods
+}
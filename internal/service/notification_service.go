@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+// NotificationService renders account messages from templates and hands them
+// to the configured Notifier
+type NotificationService struct {
+	notifier  Notifier
+	templates map[string]*template.Template // keyed by file name, each defines "subject" and "body"
+	baseURL   string
+}
+
+// templateData is available to every message template
+type templateData struct {
+	DisplayName string
+	UserID      string
+	Email       string // new address, for email changes
+	Link        string
+	ExpiresIn   string
+}
+
+func NewNotificationService(cfg *config.Config, notifier Notifier) (*NotificationService, error) {
+	entries, err := templateFS.ReadDir("templates")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*template.Template, len(entries))
+	for _, entry := range entries {
+		tmpl, err := template.ParseFS(templateFS, "templates/"+entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse notification template %s: %w", entry.Name(), err)
+		}
+		templates[entry.Name()] = tmpl
+	}
+
+	return &NotificationService{
+		notifier:  notifier,
+		templates: templates,
+		baseURL:   strings.TrimRight(cfg.AppBaseURL, "/"),
+	}, nil
+}
+
+// SendPasswordReset sends a reset link to the user's verified address
+func (s *NotificationService) SendPasswordReset(ctx context.Context, user *models.User, token string, expiresIn time.Duration) error {
+	if user.Email == nil || user.EmailVerifiedAt == nil {
+		return fmt.Errorf("user %s has no verified email address", user.ID)
+	}
+
+	return s.send(ctx, "password_reset.tmpl", *user.Email, templateData{
+		DisplayName: user.DisplayName,
+		UserID:      user.UserID,
+		Link:        s.link("/reset-password", token),
+		ExpiresIn:   formatDuration(expiresIn),
+	})
+}
+
+// SendEmailVerification sends a confirmation link to an address being added
+func (s *NotificationService) SendEmailVerification(ctx context.Context, user *models.User, email, token string, expiresIn time.Duration) error {
+	return s.send(ctx, "verify_email.tmpl", email, templateData{
+		DisplayName: user.DisplayName,
+		UserID:      user.UserID,
+		Link:        s.link("/verify-email", token),
+		ExpiresIn:   formatDuration(expiresIn),
+	})
+}
+
+// SendEmailChangeApproval asks the current verified address to confirm moving
+// the account to a new address
+func (s *NotificationService) SendEmailChangeApproval(ctx context.Context, user *models.User, newEmail, token string, expiresIn time.Duration) error {
+	if user.Email == nil || user.EmailVerifiedAt == nil {
+		return fmt.Errorf("user %s has no verified email address", user.ID)
+	}
+
+	return s.send(ctx, "approve_email_change.tmpl", *user.Email, templateData{
+		DisplayName: user.DisplayName,
+		UserID:      user.UserID,
+		Email:       newEmail,
+		Link:        s.link("/verify-email", token),
+		ExpiresIn:   formatDuration(expiresIn),
+	})
+}
+
+func (s *NotificationService) send(ctx context.Context, name, to string, data templateData) error {
+	tmpl, ok := s.templates[name]
+	if !ok {
+		return fmt.Errorf("unknown notification template %s", name)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return fmt.Errorf("failed to render %s: %w", name, err)
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return fmt.Errorf("failed to render %s: %w", name, err)
+	}
+
+	return s.notifier.Send(ctx, Message{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    body.String(),
+	})
+}
+
+// link builds a frontend URL that carries a token
+func (s *NotificationService) link(path, token string) string {
+	return s.baseURL + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+func formatDuration(d time.Duration) string {
+	if d >= time.Hour && d%time.Hour == 0 {
+		if hours := int(d / time.Hour); hours != 1 {
+			return fmt.Sprintf("%d hours", hours)
+		}
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d minutes", int(d/time.Minute))
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+)
+
+// smtpSink is an in-process SMTP server that accepts a single message. It
+// offers AUTH PLAIN but not STARTTLS, like a local development sink.
+type smtpSink struct {
+	listener net.Listener
+	done     chan struct{}
+
+	auth string // decoded AUTH PLAIN response
+	from string
+	rcpt []string
+	data string // message as received, with CRLF line endings
+	err  error
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sink := &smtpSink{listener: listener, done: make(chan struct{})}
+	go sink.serve()
+	return sink
+}
+
+func (s *smtpSink) serve() {
+	defer close(s.done)
+
+	conn, err := s.listener.Accept()
+	if err != nil {
+		s.err = err
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 sink ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			s.err = err
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+
+		switch verb {
+		case "EHLO":
+			reply("250-sink")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(command)
+			decoded, err := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			if err != nil {
+				reply("501 invalid response")
+				continue
+			}
+			s.auth = string(decoded)
+			reply("235 authenticated")
+		case "MAIL":
+			s.from = command
+			reply("250 ok")
+		case "RCPT":
+			s.rcpt = append(s.rcpt, command)
+			reply("250 ok")
+		case "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					s.err = err
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			s.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPNotifierSend(t *testing.T) {
+	sink := newSMTPSink(t)
+	host, port, _ := net.SplitHostPort(sink.listener.Addr().String())
+
+	notifier, err := NewSMTPNotifier(&config.Config{
+		SMTPHost:     host,
+		SMTPPort:     port,
+		SMTPUsername: "mailer",
+		SMTPPassword: "secret",
+		SMTPFrom:     "Shisha Log <no-reply@example.com>",
+	})
+	if err != nil {
+		t.Fatalf("NewSMTPNotifier: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = notifier.Send(ctx, Message{
+		To:      "user@example.com",
+		Subject: "パスワードの再設定",
+		Body:    "Reset your password:\nhttps://app.example.com/reset?token=abc\n.hidden line",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-sink.done
+	if sink.err != nil {
+		t.Fatalf("sink: %v", sink.err)
+	}
+
+	if sink.auth != "\x00mailer\x00secret" {
+		t.Errorf("AUTH PLAIN = %q, want the configured credentials", sink.auth)
+	}
+	if sink.from != "MAIL FROM:<no-reply@example.com>" {
+		t.Errorf("envelope sender = %q", sink.from)
+	}
+	if len(sink.rcpt) != 1 || sink.rcpt[0] != "RCPT TO:<user@example.com>" {
+		t.Errorf("envelope recipients = %q", sink.rcpt)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(sink.data))
+	if err != nil {
+		t.Fatalf("failed to parse message: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"To":                        "user@example.com",
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Content-Transfer-Encoding": "8bit",
+	} {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if from, err := msg.Header.AddressList("From"); err != nil || len(from) != 1 || from[0].Name != "Shisha Log" || from[0].Address != "no-reply@example.com" {
+		t.Errorf("From = %q, want Shisha Log <no-reply@example.com>", msg.Header.Get("From"))
+	}
+	rawSubject := msg.Header.Get("Subject")
+	if subject, err := new(mime.WordDecoder).DecodeHeader(rawSubject); err != nil || subject != "パスワードの再設定" || !strings.HasPrefix(rawSubject, "=?utf-8?q?") {
+		t.Errorf("Subject = %q, want パスワードの再設定 as an encoded word", rawSubject)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date = %q: %v", msg.Header.Get("Date"), err)
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	wantBody := "Reset your password:\r\nhttps://app.example.com/reset?token=abc\r\n.hidden line\r\n"
+	if string(body) != wantBody {
+		t.Errorf("body = %q, want %q", body, wantBody)
+	}
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+)
+
+const (
+	mockClientID    = "mock-client"
+	mockRedirectURL = "https://app.example.com/auth/callback/mock"
+	mockKeyID       = "mock-key"
+	mockSubject     = "mock-subject"
+)
+
+// mockOIDCProvider is an in-process OpenID Connect provider serving discovery,
+// authorization, token and JWKS endpoints. Its authorization endpoint signs in
+// straight away and redirects back with a code.
+type mockOIDCProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+// mockAuthorization is what the provider remembers about an issued code
+type mockAuthorization struct {
+	nonce         string
+	codeChallenge string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	m := &mockOIDCProvider{t: t, key: key, codes: make(map[string]mockAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+oidcDiscoveryPath, m.discovery)
+	mux.HandleFunc("GET /authorize", m.authorize)
+	mux.HandleFunc("POST /token", m.token)
+	mux.HandleFunc("GET /jwks", m.jwks)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	return m
+}
+
+func (m *mockOIDCProvider) config() config.OIDCProvider {
+	return config.OIDCProvider{
+		Name:        "mock",
+		Issuer:      m.server.URL,
+		ClientID:    mockClientID,
+		Scopes:      []string{"openid", "email"},
+		RedirectURL: mockRedirectURL,
+	}
+}
+
+func (m *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeMockJSON(w, http.StatusOK, oidcDiscovery{
+		Issuer:                m.server.URL,
+		AuthorizationEndpoint: m.server.URL + "/authorize",
+		TokenEndpoint:         m.server.URL + "/token",
+		JWKSURI:               m.server.URL + "/jwks",
+	})
+}
+
+func (m *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != mockClientID ||
+		query.Get("redirect_uri") != mockRedirectURL || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := rand.Text()
+	m.mu.Lock()
+	m.codes[code] = mockAuthorization{nonce: query.Get("nonce"), codeChallenge: query.Get("code_challenge")}
+	m.mu.Unlock()
+
+	redirect := url.Values{}
+	redirect.Set("code", code)
+	redirect.Set("state", query.Get("state"))
+	http.Redirect(w, r, mockRedirectURL+"?"+redirect.Encode(), http.StatusFound)
+}
+
+func (m *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("client_id") != mockClientID || r.PostForm.Get("redirect_uri") != mockRedirectURL {
+		writeMockJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	// Codes can only be redeemed once
+	m.mu.Lock()
+	authorization, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+		writeMockJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	writeMockJSON(w, http.StatusOK, map[string]string{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"id_token":     m.idToken(authorization.nonce),
+	})
+}
+
+func (m *mockOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeMockJSON(w, http.StatusOK, map[string][]providerJWK{
+		"keys": {{
+			Kty: "RSA",
+			Kid: mockKeyID,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+// idToken signs an ID token for mockSubject. email_verified is a string, as
+// Apple sends it.
+func (m *mockOIDCProvider) idToken(nonce string) string {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.server.URL,
+		"aud":            mockClientID,
+		"sub":            mockSubject,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": "true",
+		"name":           "Mock User",
+	})
+	token.Header["kid"] = mockKeyID
+
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		m.t.Errorf("failed to sign ID token: %v", err)
+	}
+	return signed
+}
+
+func writeMockJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// authorizeWithMock follows the authorization URL like a browser would and
+// returns the code and state the provider redirects back with
+func authorizeWithMock(t *testing.T, authorizationURL string) (string, string) {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authorizationURL)
+	if err != nil {
+		t.Fatalf("authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization request returned status %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %v", err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestOIDCProviderAuthorizationCodeFlow(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider := newOIDCProvider(mock.config(), mock.server.Client())
+	ctx := context.Background()
+
+	codeVerifier := rand.Text()
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	authorizationURL, err := provider.AuthorizationURL(ctx, "the-state", "the-nonce", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		t.Fatalf("AuthorizationURL: %v", err)
+	}
+
+	code, state := authorizeWithMock(t, authorizationURL)
+	if state != "the-state" {
+		t.Fatalf("state = %q, want %q", state, "the-state")
+	}
+
+	rawIDToken, err := provider.Exchange(ctx, code, codeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, "the-nonce")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+
+	if claims.Subject != mockSubject {
+		t.Errorf("Subject = %q, want %q", claims.Subject, mockSubject)
+	}
+	if claims.Email == nil || *claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("Email = %v verified %v, want user@example.com verified", claims.Email, claims.EmailVerified)
+	}
+	if claims.Name != "Mock User" {
+		t.Errorf("Name = %q, want %q", claims.Name, "Mock User")
+	}
+
+	// The code has been redeemed
+	if _, err := provider.Exchange(ctx, code, codeVerifier); err == nil {
+		t.Error("Exchange accepted a code twice")
+	}
+}
+
+func TestOIDCProviderRejectsWrongVerifierAndNonce(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider := newOIDCProvider(mock.config(), mock.server.Client())
+	ctx := context.Background()
+
+	codeVerifier := rand.Text()
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	authorizationURL, err := provider.AuthorizationURL(ctx, "state", "the-nonce", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		t.Fatalf("AuthorizationURL: %v", err)
+	}
+
+	code, _ := authorizeWithMock(t, authorizationURL)
+	if _, err := provider.Exchange(ctx, code, "wrong-verifier"); err == nil {
+		t.Error("Exchange accepted the wrong code verifier")
+	}
+
+	code, _ = authorizeWithMock(t, authorizationURL)
+	rawIDToken, err := provider.Exchange(ctx, code, codeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, err := provider.VerifyIDToken(ctx, rawIDToken, "other-nonce"); err == nil {
+		t.Error("VerifyIDToken accepted the wrong nonce")
+	}
+}
+
+func TestOIDCProviderHS256OnlyWhenConfigured(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	ctx := context.Background()
+
+	// An otherwise valid ID token signed with the client secret
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":   mock.server.URL,
+		"aud":   mockClientID,
+		"sub":   mockSubject,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "the-nonce",
+	})
+	rawIDToken, err := token.SignedString([]byte("client-secret"))
+	if err != nil {
+		t.Fatalf("failed to sign ID token: %v", err)
+	}
+
+	cfg := mock.config()
+	cfg.ClientSecret = "client-secret"
+	if _, err := newOIDCProvider(cfg, mock.server.Client()).VerifyIDToken(ctx, rawIDToken, "the-nonce"); err == nil {
+		t.Error("VerifyIDToken accepted an HS256 token from a provider not configured for it")
+	}
+
+	cfg.HS256 = true
+	if _, err := newOIDCProvider(cfg, mock.server.Client()).VerifyIDToken(ctx, rawIDToken, "the-nonce"); err != nil {
+		t.Errorf("VerifyIDToken: %v", err)
+	}
+}
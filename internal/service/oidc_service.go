@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+// OIDCStateTTL is how long an authorization request can be completed
+const OIDCStateTTL = 10 * time.Minute
+
+const oidcProvisionAttempts = 3
+
+var (
+	ErrUnknownOIDCProvider = errors.New("unknown login provider")
+	ErrInvalidOIDCState    = errors.New("invalid or expired authorization request")
+	ErrOIDCIdentityInUse   = errors.New("provider account is linked to another user")
+	ErrLastLoginMethod     = errors.New("cannot remove the only way to sign in")
+)
+
+// OIDCService signs users in with OpenID Connect providers using the
+// authorization code flow with PKCE. Provider accounts are linked to users
+// through user_identities; users signing in for the first time get a new account.
+type OIDCService struct {
+	providers map[string]*oidcProvider
+	names     []string
+	oidcRepo  *repository.OIDCRepository
+	userRepo  *repository.UserRepository
+}
+
+func NewOIDCService(
+	cfg *config.Config,
+	httpClient *http.Client,
+	oidcRepo *repository.OIDCRepository,
+	userRepo *repository.UserRepository,
+) *OIDCService {
+	providers := make(map[string]*oidcProvider, len(cfg.OIDCProviders))
+	names := make([]string, 0, len(cfg.OIDCProviders))
+	for _, provider := range cfg.OIDCProviders {
+		providers[provider.Name] = newOIDCProvider(provider, httpClient)
+		names = append(names, provider.Name)
+	}
+
+	return &OIDCService{
+		providers: providers,
+		names:     names,
+		oidcRepo:  oidcRepo,
+		userRepo:  userRepo,
+	}
+}
+
+// Providers returns the names of the configured providers
+func (s *OIDCService) Providers() []string {
+	return s.names
+}
+
+// BeginAuthorization stores a new authorization request and returns the URL to
+// send the user to along with its state, which the caller binds to the client.
+// When linkUserID is set the provider account is linked to that user instead
+// of signing in.
+func (s *OIDCService) BeginAuthorization(ctx context.Context, providerName string, linkUserID *uuid.UUID) (string, string, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownOIDCProvider
+	}
+
+	state, err := GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	codeVerifier, err := GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	authorizationURL, err := provider.AuthorizationURL(ctx, state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		return "", "", err
+	}
+
+	err = s.oidcRepo.CreateState(&models.OIDCState{
+		ID:           state,
+		Provider:     providerName,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		UserID:       linkUserID,
+		ExpiresAt:    time.Now().Add(OIDCStateTTL),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return authorizationURL, state, nil
+}
+
+// CompleteAuthorization handles the provider's callback. It returns the user
+// signing in, or the user the provider account was linked to when linked is true.
+func (s *OIDCService) CompleteAuthorization(ctx context.Context, providerName, stateID, code string) (*models.User, bool, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return nil, false, ErrUnknownOIDCProvider
+	}
+
+	// Each authorization request can only be completed once
+	state, err := s.oidcRepo.ConsumeState(stateID, providerName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, ErrInvalidOIDCState
+		}
+		return nil, false, err
+	}
+
+	rawIDToken, err := provider.Exchange(ctx, code, state.CodeVerifier)
+	if err != nil {
+		return nil, false, err
+	}
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, state.Nonce)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Only keep addresses the provider has verified
+	email := claims.Email
+	if !claims.EmailVerified {
+		email = nil
+	}
+
+	if state.UserID != nil {
+		user, err := s.link(*state.UserID, providerName, claims.Subject, email)
+		return user, true, err
+	}
+
+	user, err := s.signIn(providerName, claims, email)
+	return user, false, err
+}
+
+// ListIdentities returns the provider accounts linked to a user
+func (s *OIDCService) ListIdentities(userID uuid.UUID) ([]models.UserIdentity, error) {
+	return s.oidcRepo.GetIdentitiesByUserID(userID)
+}
+
+// UnlinkIdentity removes a linked provider account. Users without a password
+// must keep at least one provider to sign in with.
+func (s *OIDCService) UnlinkIdentity(userID, identityID uuid.UUID) error {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if user.PasswordHash == "" {
+		identities, err := s.oidcRepo.GetIdentitiesByUserID(userID)
+		if err != nil {
+			return err
+		}
+		if len(identities) <= 1 {
+			return ErrLastLoginMethod
+		}
+	}
+
+	return s.oidcRepo.DeleteIdentity(userID, identityID)
+}
+
+// link attaches a provider account to an existing user. Linking an account
+// that is already linked to the same user is a no-op.
+func (s *OIDCService) link(userID uuid.UUID, providerName, subject string, email *string) (*models.User, error) {
+	identity, err := s.oidcRepo.GetIdentity(providerName, subject)
+	switch {
+	case err == nil:
+		if identity.UserID != userID {
+			return nil, ErrOIDCIdentityInUse
+		}
+	case err == sql.ErrNoRows:
+		if _, err := s.oidcRepo.CreateIdentity(userID, providerName, subject, email); err != nil {
+			if err == repository.ErrDuplicate {
+				return nil, ErrOIDCIdentityInUse
+			}
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	return s.userRepo.GetByID(userID)
+}
+
+// signIn returns the user linked to the provider account, creating a new user
+// the first time. Accounts are never linked automatically by email address.
+func (s *OIDCService) signIn(providerName string, claims *IDTokenClaims, email *string) (*models.User, error) {
+	identity, err := s.oidcRepo.GetIdentity(providerName, claims.Subject)
+	if err == nil {
+		if err := s.oidcRepo.TouchIdentity(identity.ID, email); err != nil {
+			return nil, err
+		}
+		return s.userRepo.GetByID(identity.UserID)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	displayName := strings.TrimSpace(claims.Name)
+	if displayName == "" {
+		displayName = "Shisha lover"
+	}
+
+	for attempt := 0; attempt < oidcProvisionAttempts; attempt++ {
+		userID, err := generateUserID()
+		if err != nil {
+			return nil, err
+		}
+
+		user, err := s.oidcRepo.ProvisionUser(userID, displayName, providerName, claims.Subject, email)
+		if err == nil {
+			return user, nil
+		}
+		if err != repository.ErrDuplicate {
+			return nil, err
+		}
+
+		// Either the generated user ID was taken or a concurrent callback
+		// already created the identity
+		if identity, err := s.oidcRepo.GetIdentity(providerName, claims.Subject); err == nil {
+			return s.userRepo.GetByID(identity.UserID)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to generate a unique user ID")
+}
+
+// generateUserID returns a random user ID such as user_k3v9q2mx7d for new accounts
+func generateUserID() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate user ID: %w", err)
+	}
+	return "user_" + strings.ToLower(base32NoPadding.EncodeToString(raw))[:10], nil
+}
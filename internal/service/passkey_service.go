@@ -0,0 +1,223 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+)
+
+const challengeTTL = 5 * time.Minute
+
+type PasskeyService struct {
+	webAuthn *webauthn.WebAuthn
+}
+
+// PasskeyUser adapts a user and their stored credentials to webauthn.User
+type PasskeyUser struct {
+	User        *models.User
+	Credentials []models.PasskeyCredential
+}
+
+func (u *PasskeyUser) WebAuthnID() []byte {
+	return u.User.ID[:]
+}
+
+func (u *PasskeyUser) WebAuthnName() string {
+	return u.User.UserID
+}
+
+func (u *PasskeyUser) WebAuthnDisplayName() string {
+	return u.User.DisplayName
+}
+
+func (u *PasskeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.Credentials))
+	for _, credential := range u.Credentials {
+		id, err := DecodeCredentialID(credential.ID)
+		if err != nil {
+			continue
+		}
+
+		transports := make([]protocol.AuthenticatorTransport, len(credential.Transports))
+		for i, transport := range credential.Transports {
+			transports[i] = protocol.AuthenticatorTransport(transport)
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: credential.BackupEligible,
+				BackupState:    credential.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    credential.AAGUID,
+				SignCount: credential.Counter,
+			},
+		})
+	}
+	return credentials
+}
+
+func NewPasskeyService(cfg *config.Config) (*PasskeyService, error) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.WebAuthnRPID,
+		RPDisplayName: cfg.WebAuthnRPName,
+		RPOrigins:     cfg.WebAuthnRPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure webauthn: %w", err)
+	}
+
+	return &PasskeyService{webAuthn: w}, nil
+}
+
+// BeginRegistration starts a registration ceremony, excluding credentials the user already has
+func (s *PasskeyService) BeginRegistration(user *PasskeyUser) (*protocol.CredentialCreation, *models.AuthChallenge, error) {
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.Credentials))
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := s.webAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	challenge, err := newChallenge(models.ChallengeTypeRegistration, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	challenge.UserID = &user.User.ID
+
+	return creation, challenge, nil
+}
+
+// FinishRegistration verifies the attestation response and returns the credential to store
+func (s *PasskeyService) FinishRegistration(user *PasskeyUser, challenge *models.AuthChallenge, response []byte) (*models.PasskeyCredential, error) {
+	session, err := decodeSession(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.webAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+
+	return &models.PasskeyCredential{
+		ID:              EncodeCredentialID(credential.ID),
+		UserID:          user.User.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Counter:         credential.Authenticator.SignCount,
+		AAGUID:          credential.Authenticator.AAGUID,
+		Transports:      transports,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}, nil
+}
+
+// BeginLogin starts a discoverable authentication ceremony where the authenticator
+// picks the account. Passkeys are registered as resident keys, so no credential
+// list is sent and the options don't reveal whether an account exists.
+func (s *PasskeyService) BeginLogin() (*protocol.CredentialAssertion, *models.AuthChallenge, error) {
+	assertion, session, err := s.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	challenge, err := newChallenge(models.ChallengeTypeAuthentication, session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return assertion, challenge, nil
+}
+
+// FinishLogin verifies the assertion response. lookup is called with the
+// credential ID and user handle to resolve the account.
+func (s *PasskeyService) FinishLogin(lookup func(credentialID string, userHandle []byte) (*PasskeyUser, error), challenge *models.AuthChallenge, response []byte) (*PasskeyUser, *webauthn.Credential, error) {
+	session, err := decodeSession(challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var resolved *PasskeyUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		resolved, err = lookup(EncodeCredentialID(rawID), userHandle)
+		if err != nil {
+			return nil, err
+		}
+		return resolved, nil
+	}
+
+	_, credential, err := s.webAuthn.ValidatePasskeyLogin(handler, *session, parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resolved, credential, nil
+}
+
+func EncodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+func DecodeCredentialID(id string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(id)
+}
+
+func newChallenge(challengeType string, session *webauthn.SessionData) (*models.AuthChallenge, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode webauthn session: %w", err)
+	}
+
+	expiresAt := time.Now().Add(challengeTTL)
+	if !session.Expires.IsZero() && session.Expires.Before(expiresAt) {
+		expiresAt = session.Expires
+	}
+
+	return &models.AuthChallenge{
+		Challenge:   session.Challenge,
+		Type:        challengeType,
+		SessionData: data,
+		ExpiresAt:   expiresAt,
+	}, nil
+}
+
+func decodeSession(challenge *models.AuthChallenge) (*webauthn.SessionData, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal(challenge.SessionData, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode webauthn session: %w", err)
+	}
+	return &session, nil
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// passwordMaxLength bounds the work done hashing a password
+const passwordMaxLength = 256
+
+// Password policy rules reported in PasswordPolicyError
+const (
+	PasswordRuleMinLength    = "min_length"
+	PasswordRuleMaxLength    = "max_length"
+	PasswordRuleEntropy      = "entropy"
+	PasswordRuleCommon       = "common_password"
+	PasswordRulePersonalInfo = "personal_info"
+)
+
+//go:embed data/common_passwords.bloom
+var commonPasswordsData []byte
+
+var commonPasswords = mustLoadBloomFilter(commonPasswordsData)
+
+// PasswordPolicyError describes the rule a rejected password broke
+type PasswordPolicyError struct {
+	Rule    string
+	Message string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Message
+}
+
+// ValidatePasswordStrength checks a new password against the policy. userID and
+// displayName belong to the account the password is for and may be empty.
+func (s *PasswordService) ValidatePasswordStrength(password, userID, displayName string) error {
+	length := utf8.RuneCountInString(password)
+	if length < s.minLength {
+		return &PasswordPolicyError{
+			Rule:    PasswordRuleMinLength,
+			Message: fmt.Sprintf("Password must be at least %d characters long", s.minLength),
+		}
+	}
+	if length > passwordMaxLength {
+		return &PasswordPolicyError{
+			Rule:    PasswordRuleMaxLength,
+			Message: fmt.Sprintf("Password must be at most %d characters long", passwordMaxLength),
+		}
+	}
+
+	// Fold full-width and other compatibility forms so "ｐａｓｓｗｏｒｄ" matches "password"
+	lower := strings.ToLower(norm.NFKC.String(password))
+	for _, info := range personalInfo(userID, displayName) {
+		if strings.Contains(lower, info) {
+			return &PasswordPolicyError{
+				Rule:    PasswordRulePersonalInfo,
+				Message: "Password must not contain your user ID or display name",
+			}
+		}
+	}
+
+	if isCommonPassword(lower) {
+		return &PasswordPolicyError{
+			Rule:    PasswordRuleCommon,
+			Message: "Password is too common or has appeared in a data breach",
+		}
+	}
+
+	if estimatePasswordEntropy(password) < float64(s.minEntropy) {
+		return &PasswordPolicyError{
+			Rule:    PasswordRuleEntropy,
+			Message: "Password is too easy to guess, try a longer password or a few unrelated words",
+		}
+	}
+
+	return nil
+}
+
+// isCommonPassword looks up the lowercased password, also without the digits and
+// symbols commonly appended to a listed password such as "password123!"
+func isCommonPassword(lower string) bool {
+	if commonPasswords.Contains(lower) {
+		return true
+	}
+
+	base := strings.TrimRightFunc(lower, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+	return utf8.RuneCountInString(base) >= 4 && base != lower && commonPasswords.Contains(base)
+}
+
+// personalInfo returns the lowercased user ID, display name and the longer words
+// of the display name
+func personalInfo(userID, displayName string) []string {
+	var info []string
+	add := func(value string) {
+		value = strings.ToLower(norm.NFKC.String(strings.TrimSpace(value)))
+		if utf8.RuneCountInString(value) >= 3 {
+			info = append(info, value)
+		}
+	}
+
+	add(userID)
+	add(displayName)
+	if words := strings.Fields(displayName); len(words) > 1 {
+		for _, word := range words {
+			if utf8.RuneCountInString(word) >= 4 {
+				add(word)
+			}
+		}
+	}
+
+	return info
+}
+
+// estimatePasswordEntropy estimates the bits of a password from the character
+// classes it uses. Characters repeating or continuing a sequence from the
+// previous one (aaa, abc, 321) only count for one bit.
+func estimatePasswordEntropy(password string) float64 {
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	for _, r := range password {
+		switch {
+		case 'a' <= r && r <= 'z':
+			hasLower = true
+		case 'A' <= r && r <= 'Z':
+			hasUpper = true
+		case '0' <= r && r <= '9':
+			hasDigit = true
+		case r < utf8.RuneSelf:
+			hasSymbol = true
+		default:
+			// Kana, kanji, full-width and other non-ASCII characters
+			hasOther = true
+		}
+	}
+
+	pool := 0
+	if hasLower {
+		pool += 26
+	}
+	if hasUpper {
+		pool += 26
+	}
+	if hasDigit {
+		pool += 10
+	}
+	if hasSymbol {
+		pool += 33
+	}
+	if hasOther {
+		pool += 100
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bitsPerChar := math.Log2(float64(pool))
+	var bits float64
+	previous := rune(-1)
+	for _, r := range password {
+		if diff := r - previous; previous >= 0 && diff >= -1 && diff <= 1 {
+			bits++
+		} else {
+			bits += bitsPerChar
+		}
+		previous = r
+	}
+
+	return bits
+}
+
+func mustLoadBloomFilter(data []byte) *BloomFilter {
+	filter := &BloomFilter{}
+	if err := filter.UnmarshalBinary(data); err != nil {
+		panic("invalid embedded bloom filter: " + err.Error())
+	}
+	return filter
+}
@@ -2,67 +2,150 @@ package service
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// PasswordResetTTL is how long a password reset link works
+const PasswordResetTTL = time.Hour
+
+var (
+	ErrPasswordMismatch    = errors.New("password does not match")
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+	argon2PHCEncoding      = base64.RawStdEncoding
+)
+
+// argon2Params are the cost parameters of an Argon2id hash
+type argon2Params struct {
+	memory      uint32 // KiB
+	iterations  uint32
+	parallelism uint8
+}
+
+// PasswordService hashes passwords with Argon2id, stored in PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash). bcrypt hashes from before the
+// switch are still verified and upgraded on the next login via NeedsRehash.
 type PasswordService struct {
-	cost int
+	params     argon2Params
+	minLength  int
+	minEntropy int
 }
 
-func NewPasswordService() *PasswordService {
+func NewPasswordService(cfg *config.Config) *PasswordService {
+	parallelism := cfg.Argon2Parallelism
+	if parallelism > 255 {
+		parallelism = 255
+	}
+
 	return &PasswordService{
-		cost: bcrypt.DefaultCost,
+		params: argon2Params{
+			memory:      uint32(cfg.Argon2Memory),
+			iterations:  uint32(cfg.Argon2Iterations),
+			parallelism: uint8(parallelism),
+		},
+		minLength:  cfg.PasswordMinLength,
+		minEntropy: cfg.PasswordMinEntropy,
 	}
 }
 
 func (s *PasswordService) HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
-	if err != nil {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
 		return "", fmt.Errorf("failed to hash password: %w", err)
 	}
-	return string(bytes), nil
+
+	key := argon2.IDKey([]byte(password), salt, s.params.iterations, s.params.memory, s.params.parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		s.params.memory, s.params.iterations, s.params.parallelism,
+		argon2PHCEncoding.EncodeToString(salt), argon2PHCEncoding.EncodeToString(key)), nil
 }
 
+// VerifyPassword checks a password against an Argon2id or bcrypt hash
 func (s *PasswordService) VerifyPassword(password, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2Hash(hash)
+		if err != nil {
+			return err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return ErrPasswordMismatch
+		}
+		return nil
+	default:
+		// Includes accounts without a password
+		return ErrUnknownPasswordHash
+	}
 }
 
-func (s *PasswordService) GenerateToken() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", fmt.Errorf("failed to generate random token: %w", err)
+// NeedsRehash reports whether a hash uses an older algorithm or different
+// parameters than new hashes. Call it after a successful VerifyPassword.
+func (s *PasswordService) NeedsRehash(hash string) bool {
+	params, _, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
 	}
-	return hex.EncodeToString(bytes), nil
+	return params != s.params || len(key) != argon2KeyLength
 }
 
-func (s *PasswordService) ValidatePasswordStrength(password string) error {
-	if len(password) < 8 {
-		return fmt.Errorf("password must be at least 8 characters long")
+// decodeArgon2Hash parses an Argon2id hash in PHC string format
+func decodeArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownPasswordHash
 	}
 
-	var (
-		hasUpper  bool
-		hasLower  bool
-		hasNumber bool
-	)
-
-	for _, char := range password {
-		switch {
-		case 'A' <= char && char <= 'Z':
-			hasUpper = true
-		case 'a' <= char && char <= 'z':
-			hasLower = true
-		case '0' <= char && char <= '9':
-			hasNumber = true
-		}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	// argon2 panics on zero iterations or parallelism
+	if params.memory == 0 || params.iterations == 0 || params.parallelism == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
 	}
 
-	if !hasUpper || !hasLower || !hasNumber {
-		return fmt.Errorf("password must contain at least one uppercase letter, one lowercase letter, and one number")
+	salt, err := argon2PHCEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	key, err := argon2PHCEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
 	}
 
-	return nil
+	return params, salt, key, nil
+}
+
+func (s *PasswordService) GenerateToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
 }
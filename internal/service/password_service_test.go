@@ -0,0 +1,142 @@
+package service
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestPasswordService uses tiny Argon2 parameters to keep the tests fast
+func newTestPasswordService(memory, iterations, parallelism int) *PasswordService {
+	return NewPasswordService(&config.Config{
+		Argon2Memory:      memory,
+		Argon2Iterations:  iterations,
+		Argon2Parallelism: parallelism,
+	})
+}
+
+func TestPasswordServiceArgon2id(t *testing.T) {
+	s := newTestPasswordService(64, 1, 1)
+
+	hash, err := s.HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash = %q, want an Argon2id PHC string with the configured parameters", hash)
+	}
+
+	if err := s.VerifyPassword("correct horse", hash); err != nil {
+		t.Errorf("VerifyPassword with the right password: %v", err)
+	}
+	if err := s.VerifyPassword("wrong horse", hash); err != ErrPasswordMismatch {
+		t.Errorf("VerifyPassword with the wrong password = %v, want ErrPasswordMismatch", err)
+	}
+	if s.NeedsRehash(hash) {
+		t.Error("NeedsRehash = true for a hash made with the current parameters")
+	}
+}
+
+func TestPasswordServiceUpgradesBcrypt(t *testing.T) {
+	s := newTestPasswordService(64, 1, 1)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to make bcrypt hash: %v", err)
+	}
+
+	if err := s.VerifyPassword("correct horse", string(hash)); err != nil {
+		t.Errorf("VerifyPassword with the right password: %v", err)
+	}
+	if err := s.VerifyPassword("wrong horse", string(hash)); err != ErrPasswordMismatch {
+		t.Errorf("VerifyPassword with the wrong password = %v, want ErrPasswordMismatch", err)
+	}
+	if !s.NeedsRehash(string(hash)) {
+		t.Error("NeedsRehash = false for a bcrypt hash")
+	}
+}
+
+func TestPasswordServiceNeedsRehashOnParameterChange(t *testing.T) {
+	hash, err := newTestPasswordService(64, 1, 1).HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		service *PasswordService
+	}{
+		{name: "memory", service: newTestPasswordService(128, 1, 1)},
+		{name: "iterations", service: newTestPasswordService(64, 2, 1)},
+		{name: "parallelism", service: newTestPasswordService(64, 1, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Old hashes keep working with the parameters stored in them
+			if err := tt.service.VerifyPassword("correct horse", hash); err != nil {
+				t.Errorf("VerifyPassword: %v", err)
+			}
+			if !tt.service.NeedsRehash(hash) {
+				t.Error("NeedsRehash = false after the parameters changed")
+			}
+		})
+	}
+
+	// A key of another length is upgraded too
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("correct horse"), salt, 1, 64, 1, 16)
+	shortKeyHash := "$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+	s := newTestPasswordService(64, 1, 1)
+	if err := s.VerifyPassword("correct horse", shortKeyHash); err != nil {
+		t.Errorf("VerifyPassword with a 16 byte key: %v", err)
+	}
+	if !s.NeedsRehash(shortKeyHash) {
+		t.Error("NeedsRehash = false for a 16 byte key")
+	}
+}
+
+func TestPasswordServiceRejectsMalformedHashes(t *testing.T) {
+	s := newTestPasswordService(64, 1, 1)
+	const (
+		salt = "MDEyMzQ1Njc4OWFiY2RlZg"
+		key  = "c2hvcnQga2V5IGZvciB0ZXN0aW5nIHB1cnBvc2VzISE"
+	)
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{name: "no password", hash: ""},
+		{name: "plain text", hash: "correct horse"},
+		{name: "argon2i", hash: "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{name: "unknown version", hash: "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{name: "missing version", hash: "$argon2id$m=64,t=1,p=1$" + salt + "$" + key},
+		{name: "missing parameter", hash: "$argon2id$v=19$m=64,t=1$" + salt + "$" + key},
+		{name: "parameters out of order", hash: "$argon2id$v=19$t=1,m=64,p=1$" + salt + "$" + key},
+		{name: "parallelism overflows", hash: "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key},
+		{name: "zero iterations", hash: "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{name: "zero parallelism", hash: "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{name: "zero memory", hash: "$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key},
+		{name: "invalid salt", hash: "$argon2id$v=19$m=64,t=1,p=1$not*base64$" + key},
+		{name: "invalid key", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$not*base64"},
+		{name: "empty key", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$"},
+		{name: "missing key", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt},
+		{name: "extra field", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.VerifyPassword("correct horse", tt.hash); err != ErrUnknownPasswordHash {
+				t.Errorf("VerifyPassword = %v, want ErrUnknownPasswordHash", err)
+			}
+			if !s.NeedsRehash(tt.hash) {
+				t.Error("NeedsRehash = false for a malformed hash")
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+const (
+	// PersonalAccessTokenPrefix marks personal access tokens so they can be told
+	// apart from JWTs and found by secret scanners
+	PersonalAccessTokenPrefix = "slp_"
+
+	personalAccessTokenDisplayLength = 8 // characters kept in token_prefix
+)
+
+var (
+	ErrInvalidPersonalAccessToken = errors.New("invalid or expired personal access token")
+	ErrInvalidScope               = errors.New("invalid scope")
+)
+
+// PersonalAccessTokenService creates and checks personal access tokens. The raw
+// token is only returned once, on creation.
+type PersonalAccessTokenService struct {
+	tokenRepo *repository.PersonalAccessTokenRepository
+}
+
+func NewPersonalAccessTokenService(tokenRepo *repository.PersonalAccessTokenRepository) *PersonalAccessTokenService {
+	return &PersonalAccessTokenService{tokenRepo: tokenRepo}
+}
+
+// Create issues a new token and returns it together with the raw token value
+func (s *PersonalAccessTokenService) Create(userID uuid.UUID, name string, scopes []string, expiresAt *time.Time) (*models.PersonalAccessToken, string, error) {
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := GenerateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	raw := PersonalAccessTokenPrefix + secret
+
+	token, err := s.tokenRepo.Create(&models.PersonalAccessToken{
+		UserID:      userID,
+		Name:        name,
+		TokenHash:   HashToken(raw),
+		TokenPrefix: raw[:len(PersonalAccessTokenPrefix)+personalAccessTokenDisplayLength],
+		Scopes:      scopes,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return token, raw, nil
+}
+
+// Authenticate returns the token for a raw token value and records its use
+func (s *PersonalAccessTokenService) Authenticate(raw string) (*models.PersonalAccessToken, error) {
+	token, err := s.tokenRepo.GetByHash(HashToken(raw))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidPersonalAccessToken
+		}
+		return nil, err
+	}
+
+	if err := s.tokenRepo.TouchLastUsed(token.ID, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (s *PersonalAccessTokenService) List(userID uuid.UUID) ([]models.PersonalAccessToken, error) {
+	return s.tokenRepo.GetByUserID(userID)
+}
+
+// Revoke deletes one of the user's tokens. It returns sql.ErrNoRows if there is no such token.
+func (s *PersonalAccessTokenService) Revoke(userID, tokenID uuid.UUID) error {
+	return s.tokenRepo.Delete(userID, tokenID)
+}
+
+// IsPersonalAccessToken reports whether a bearer token is a personal access token
+func IsPersonalAccessToken(bearer string) bool {
+	return strings.HasPrefix(bearer, PersonalAccessTokenPrefix)
+}
+
+// normalizeScopes checks every scope is known and removes duplicates
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+
+	seen := map[string]bool{}
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		known := false
+		for _, valid := range models.PersonalAccessTokenScopes {
+			if scope == valid {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+
+	return normalized, nil
+}
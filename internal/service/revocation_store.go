@@ -0,0 +1,96 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RevocationStore records access tokens that must be rejected before they expire.
+// Entries only need to be kept until the revoked tokens would have expired anyway.
+type RevocationStore interface {
+	// Revoke rejects a single token, identified by its jti claim
+	Revoke(jti string, expiresAt time.Time) error
+	// RevokeAllForUser rejects every token issued to the user before issuedBefore
+	RevokeAllForUser(userID uuid.UUID, issuedBefore, expiresAt time.Time) error
+	// IsRevoked reports whether a token with the given claims has been revoked
+	IsRevoked(jti string, userID uuid.UUID, issuedAt time.Time) (bool, error)
+}
+
+// MemoryRevocationStore keeps revocations in process memory. It is only suitable
+// for single instance deployments since revocations are not shared or persisted.
+type MemoryRevocationStore struct {
+	mu        sync.Mutex
+	tokens    map[string]time.Time
+	users     map[uuid.UUID]userRevocation
+	lastPrune time.Time
+}
+
+type userRevocation struct {
+	issuedBefore time.Time
+	expiresAt    time.Time
+}
+
+const revocationPruneInterval = time.Minute
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens:    make(map[string]time.Time),
+		users:     make(map[uuid.UUID]userRevocation),
+		lastPrune: time.Now(),
+	}
+}
+
+func (s *MemoryRevocationStore) Revoke(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked()
+	s.tokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeAllForUser(userID uuid.UUID, issuedBefore, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked()
+	s.users[userID] = userRevocation{issuedBefore: issuedBefore, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(jti string, userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked()
+	if _, ok := s.tokens[jti]; ok {
+		return true, nil
+	}
+	if revocation, ok := s.users[userID]; ok && issuedAt.Before(revocation.issuedBefore) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// pruneLocked drops entries for tokens that have expired on their own. It runs at
+// most once per revocationPruneInterval; the caller must hold s.mu.
+func (s *MemoryRevocationStore) pruneLocked() {
+	now := time.Now()
+	if now.Sub(s.lastPrune) < revocationPruneInterval {
+		return
+	}
+	s.lastPrune = now
+
+	for jti, expiresAt := range s.tokens {
+		if now.After(expiresAt) {
+			delete(s.tokens, jti)
+		}
+	}
+	for userID, revocation := range s.users {
+		if now.After(revocation.expiresAt) {
+			delete(s.users, userID)
+		}
+	}
+}
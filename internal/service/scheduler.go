@@ -0,0 +1,26 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RunPeriodically calls job every interval until ctx is cancelled. The first run
+// happens immediately. Errors are logged and the job is tried again next time.
+func RunPeriodically(ctx context.Context, name string, interval time.Duration, job func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job(ctx); err != nil {
+			log.Printf("Scheduled job %s failed: %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
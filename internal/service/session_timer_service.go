@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+// SessionTimerService times live sessions. A session left running for longer
+// than the maximum duration is stopped at that duration, either by the
+// background job or as soon as its owner starts, stops or looks for a session.
+type SessionTimerService struct {
+	sessionRepo *repository.SessionRepository
+	maxDuration time.Duration
+}
+
+func NewSessionTimerService(cfg *config.Config, sessionRepo *repository.SessionRepository) *SessionTimerService {
+	return &SessionTimerService{
+		sessionRepo: sessionRepo,
+		maxDuration: ParseDurationSetting(cfg.SessionMaxDuration, 6*time.Hour),
+	}
+}
+
+// Start starts the session owned by userID
+func (s *SessionTimerService) Start(ctx context.Context, sessionID, userID string) error {
+	// An overdue session must not keep the user from starting another one
+	if _, err := s.sessionRepo.StopOverdue(ctx, userID, s.maxDuration); err != nil {
+		return err
+	}
+	return s.sessionRepo.Start(ctx, sessionID, time.Now())
+}
+
+// Stop stops the session, at the maximum duration if it ran longer
+func (s *SessionTimerService) Stop(ctx context.Context, sessionID string) error {
+	return s.sessionRepo.Stop(ctx, sessionID, time.Now(), s.maxDuration)
+}
+
+// Active returns the user's running session, or repository.ErrSessionNotFound
+func (s *SessionTimerService) Active(ctx context.Context, userID string) (*models.SessionWithFlavors, error) {
+	if _, err := s.sessionRepo.StopOverdue(ctx, userID, s.maxDuration); err != nil {
+		return nil, err
+	}
+	return s.sessionRepo.GetActive(ctx, userID)
+}
+
+// StopOverdue stops every session running past the maximum duration. It is run
+// periodically.
+func (s *SessionTimerService) StopOverdue(ctx context.Context) error {
+	stopped, err := s.sessionRepo.StopOverdue(ctx, "", s.maxDuration)
+	if err != nil {
+		return err
+	}
+	if stopped > 0 {
+		log.Printf("Stopped %d sessions running for longer than %s", stopped, s.maxDuration)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrAccountSuspended    = errors.New("account suspended")
+)
+
+// TokenPair is what clients receive after a successful login or refresh
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // access token lifetime in seconds
+}
+
+// TokenService issues short-lived access tokens together with rotating refresh tokens
+type TokenService struct {
+	jwtService           *JWTService
+	userRepo             *repository.UserRepository
+	refreshRepo          *repository.RefreshTokenRepository
+	deviceRepo           *repository.DeviceRepository
+	patRepo              *repository.PersonalAccessTokenRepository
+	revocationStore      RevocationStore
+	refreshTokenDuration time.Duration
+}
+
+func NewTokenService(
+	cfg *config.Config,
+	jwtService *JWTService,
+	userRepo *repository.UserRepository,
+	refreshRepo *repository.RefreshTokenRepository,
+	deviceRepo *repository.DeviceRepository,
+	patRepo *repository.PersonalAccessTokenRepository,
+	revocationStore RevocationStore,
+) *TokenService {
+	duration := 30 * 24 * time.Hour // Default 30 days
+	if cfg.RefreshTokenDuration != "" {
+		parsed, err := time.ParseDuration(cfg.RefreshTokenDuration)
+		if err == nil {
+			duration = parsed
+		}
+	}
+
+	return &TokenService{
+		jwtService:           jwtService,
+		userRepo:             userRepo,
+		refreshRepo:          refreshRepo,
+		deviceRepo:           deviceRepo,
+		patRepo:              patRepo,
+		revocationStore:      revocationStore,
+		refreshTokenDuration: duration,
+	}
+}
+
+// IssueTokens starts a new refresh token family for a fresh login and records
+// the client as a signed-in device
+func (s *TokenService) IssueTokens(user *models.User, client ClientInfo) (*TokenPair, error) {
+	return s.issue(user, uuid.New(), nil, client)
+}
+
+// IssueMFAToken returns the challenge token handed out after the password step
+// of a login when the account has two-factor authentication enabled
+func (s *TokenService) IssueMFAToken(user *models.User) (string, error) {
+	return s.jwtService.GenerateMFAToken(user.ID.String(), user.TokenVersion)
+}
+
+// VerifyMFAToken returns the user an MFA challenge token was issued for. Tokens
+// issued before a password change are rejected.
+func (s *TokenService) VerifyMFAToken(mfaToken string) (*models.User, error) {
+	claims, err := s.jwtService.ValidateMFAToken(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidMFAToken
+		}
+		return nil, err
+	}
+
+	if user.TokenVersion != claims.TokenVersion {
+		return nil, ErrInvalidMFAToken
+	}
+
+	return user, nil
+}
+
+// Refresh rotates a refresh token. Presenting a token that has already been
+// rotated or revoked revokes its whole family, since either the client or an
+// attacker is holding a stolen copy.
+func (s *TokenService) Refresh(refreshToken string, client ClientInfo) (*TokenPair, *models.User, error) {
+	stored, err := s.refreshRepo.GetByHash(HashToken(refreshToken))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, ErrInvalidRefreshToken
+		}
+		return nil, nil, err
+	}
+
+	if stored.UsedAt != nil || stored.RevokedAt != nil {
+		if err := s.refreshRepo.RevokeFamily(stored.FamilyID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	// Reload the user so the new access token carries the current token version
+	user, err := s.userRepo.GetByID(stored.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pair, err := s.issue(user, stored.FamilyID, &stored.ID, client)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Lost a race against another request using the same token, or
+			// the device was signed out meanwhile
+			if err := s.refreshRepo.RevokeFamily(stored.FamilyID); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, ErrRefreshTokenReused
+		}
+		return nil, nil, err
+	}
+
+	return pair, user, nil
+}
+
+// Logout revokes the access token identified by jti and signs out the device it
+// was issued to. Access tokens issued before devices were tracked carry no
+// device, so the refresh token, when given, identifies the family to revoke.
+func (s *TokenService) Logout(userID uuid.UUID, jti string, expiresAt time.Time, sessionID, refreshToken string) error {
+	if err := s.revocationStore.Revoke(jti, expiresAt); err != nil {
+		return err
+	}
+
+	familyID, err := uuid.Parse(sessionID)
+	if err != nil {
+		if refreshToken == "" {
+			return nil
+		}
+
+		stored, err := s.refreshRepo.GetByHash(HashToken(refreshToken))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+
+		// Never let one user revoke another user's session
+		if stored.UserID != userID {
+			return nil
+		}
+		familyID = stored.FamilyID
+	}
+
+	if err := s.refreshRepo.RevokeDevice(userID, familyID); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// LogoutAll revokes every access and refresh token issued to the user so far
+func (s *TokenService) LogoutAll(userID uuid.UUID) error {
+	// iat only has second precision, so a token issued right after this call
+	// must not fall before the cutoff. Access tokens from earlier in the same
+	// second are still rejected because their device is signed out below.
+	now := time.Now()
+	issuedBefore := now.Truncate(time.Second)
+	if err := s.revocationStore.RevokeAllForUser(userID, issuedBefore, now.Add(s.jwtService.TokenDuration())); err != nil {
+		return err
+	}
+
+	return s.RevokeRefreshTokens(userID)
+}
+
+// RevokeAll signs the user out everywhere like LogoutAll and also deletes their
+// personal access tokens
+func (s *TokenService) RevokeAll(userID uuid.UUID) error {
+	if err := s.LogoutAll(userID); err != nil {
+		return err
+	}
+
+	return s.patRepo.DeleteByUserID(userID)
+}
+
+// RevokeRefreshTokens revokes every refresh token of the user and forgets their
+// devices. Access tokens are invalidated separately by bumping the user's token
+// version.
+func (s *TokenService) RevokeRefreshTokens(userID uuid.UUID) error {
+	return s.refreshRepo.RevokeAllForUser(userID)
+}
+
+// ListDevices returns the devices the user is signed in on
+func (s *TokenService) ListDevices(userID uuid.UUID) ([]models.AuthDevice, error) {
+	return s.deviceRepo.GetByUserID(userID)
+}
+
+// RevokeDevice signs out one device. Its refresh tokens stop working and its
+// access tokens are rejected because the device no longer exists. It returns
+// sql.ErrNoRows if the user has no such device.
+func (s *TokenService) RevokeDevice(userID, deviceID uuid.UUID) error {
+	return s.refreshRepo.RevokeDevice(userID, deviceID)
+}
+
+// issue creates the tokens of a family. When rotatedID is set it replaces that
+// refresh token and returns sql.ErrNoRows if the token can no longer be used.
+func (s *TokenService) issue(user *models.User, familyID uuid.UUID, rotatedID *uuid.UUID, client ClientInfo) (*TokenPair, error) {
+	// Every login method and refreshes end up here
+	if user.SuspendedAt != nil {
+		return nil, ErrAccountSuspended
+	}
+
+	accessToken, err := s.jwtService.GenerateToken(user.ID.String(), user.Role, user.TokenVersion, familyID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &models.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: HashToken(refreshToken),
+		ExpiresAt: time.Now().Add(s.refreshTokenDuration),
+	}
+	device := &models.AuthDevice{
+		ID:          familyID,
+		UserID:      user.ID,
+		DeviceLabel: DeviceLabel(client.UserAgent),
+		UserAgent:   optionalString(client.UserAgent),
+		IPAddress:   optionalString(client.IPAddress),
+		ExpiresAt:   stored.ExpiresAt,
+	}
+
+	if rotatedID != nil {
+		if err := s.refreshRepo.Rotate(*rotatedID, stored, device); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := s.refreshRepo.Create(stored); err != nil {
+			return nil, err
+		}
+		if err := s.deviceRepo.Save(device); err != nil {
+			return nil, err
+		}
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(s.jwtService.TokenDuration().Seconds()),
+	}, nil
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
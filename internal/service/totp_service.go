@@ -0,0 +1,184 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+)
+
+const (
+	totpPeriod        = 30 // seconds per time step
+	totpDigits        = 6
+	totpSkew          = 1 // accept codes from one step before or after
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrInvalidTOTPCode = errors.New("invalid authentication code")
+	base32NoPadding    = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TOTPService implements RFC 6238 time-based one-time passwords. Secrets are
+// encrypted with AES-GCM before they are stored.
+type TOTPService struct {
+	issuer string
+	aead   cipher.AEAD
+	now    func() time.Time
+}
+
+func NewTOTPService(cfg *config.Config) (*TOTPService, error) {
+	keyMaterial := cfg.MFAEncryptionKey
+	if keyMaterial == "" {
+		keyMaterial = cfg.JWTSecret
+	}
+	if keyMaterial == "" {
+		return nil, fmt.Errorf("MFA_ENCRYPTION_KEY must be set to encrypt TOTP secrets")
+	}
+
+	key := sha256.Sum256([]byte(keyMaterial))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTPService{
+		issuer: cfg.WebAuthnRPName,
+		aead:   aead,
+		now:    time.Now,
+	}, nil
+}
+
+// GenerateSecret returns a new base32 encoded 160-bit secret
+func (s *TOTPService) GenerateSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI authenticator apps read from a QR code
+func (s *TOTPService) ProvisioningURI(secret, accountName string) string {
+	label := url.PathEscape(s.issuer) + ":" + url.PathEscape(accountName)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", s.issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Validate checks a code against the secret and returns the matched time step.
+// Steps at or before lastUsedStep are rejected so a code cannot be replayed.
+func (s *TOTPService) Validate(secret, code string, lastUsedStep int64) (int64, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, err
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, ErrInvalidTOTPCode
+	}
+
+	current := s.now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(generateTOTP(key, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+
+	return 0, ErrInvalidTOTPCode
+}
+
+// EncryptSecret encrypts a secret for storage
+func (s *TOTPService) EncryptSecret(secret string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret reverses EncryptSecret
+func (s *TOTPService) DecryptSecret(encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return "", errors.New("encrypted secret is too short")
+	}
+
+	secret, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+	return string(secret), nil
+}
+
+// GenerateRecoveryCodes returns new one-time recovery codes and the hashes to store
+func (s *TOTPService) GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		encoded := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		codes[i] = encoded[:4] + "-" + encoded[4:]
+		hashes[i] = HashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code, ignoring case, spaces and dashes
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return HashToken(normalized)
+}
+
+// generateTOTP computes the HOTP value (RFC 4226) for a time step
+func generateTOTP(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
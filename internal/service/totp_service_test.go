@@ -0,0 +1,94 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 appendix B test vectors,
+// "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func newTestTOTPService(t *testing.T, now time.Time) *TOTPService {
+	t.Helper()
+
+	s, err := NewTOTPService(&config.Config{MFAEncryptionKey: "test-key"})
+	if err != nil {
+		t.Fatalf("NewTOTPService: %v", err)
+	}
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestGenerateTOTPRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes, we use their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := generateTOTP([]byte("12345678901234567890"), tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+
+		s := newTestTOTPService(t, time.Unix(tt.unix, 0))
+		step, err := s.Validate(rfc6238Secret, tt.want, 0)
+		if err != nil {
+			t.Errorf("Validate at %d: %v", tt.unix, err)
+		} else if step != tt.unix/totpPeriod {
+			t.Errorf("Validate at %d matched step %d, want %d", tt.unix, step, tt.unix/totpPeriod)
+		}
+	}
+}
+
+func TestTOTPValidateWindowAndReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	key := []byte("12345678901234567890")
+	s := newTestTOTPService(t, now)
+
+	tests := []struct {
+		name         string
+		code         string
+		lastUsedStep int64
+		wantStep     int64 // 0 if the code must be rejected
+	}{
+		{name: "current step", code: generateTOTP(key, current), wantStep: current},
+		{name: "surrounding whitespace", code: " " + generateTOTP(key, current) + " ", wantStep: current},
+		{name: "previous step", code: generateTOTP(key, current-1), wantStep: current - 1},
+		{name: "next step", code: generateTOTP(key, current+1), wantStep: current + 1},
+		{name: "two steps ago", code: generateTOTP(key, current-2)},
+		{name: "two steps ahead", code: generateTOTP(key, current+2)},
+		{name: "replayed current step", code: generateTOTP(key, current), lastUsedStep: current},
+		{name: "current step after the previous one was used", code: generateTOTP(key, current), lastUsedStep: current - 1, wantStep: current},
+		{name: "previous step after the current one was used", code: generateTOTP(key, current-1), lastUsedStep: current},
+		{name: "next step after the current one was used", code: generateTOTP(key, current+1), lastUsedStep: current, wantStep: current + 1},
+		{name: "too short", code: generateTOTP(key, current)[1:]},
+		{name: "too long", code: generateTOTP(key, current) + "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := s.Validate(rfc6238Secret, tt.code, tt.lastUsedStep)
+			if tt.wantStep == 0 {
+				if err != ErrInvalidTOTPCode {
+					t.Errorf("Validate(%q, %d) = %d, %v, want ErrInvalidTOTPCode", tt.code, tt.lastUsedStep, step, err)
+				}
+				return
+			}
+			if err != nil || step != tt.wantStep {
+				t.Errorf("Validate(%q, %d) = %d, %v, want step %d", tt.code, tt.lastUsedStep, step, err, tt.wantStep)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toof-jp/shisha-log-backend/internal/config"
+	"github.com/toof-jp/shisha-log-backend/internal/models"
+	"github.com/toof-jp/shisha-log-backend/internal/repository"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Reasons reported in UserIDError
+const (
+	UserIDInvalid  = "invalid"
+	UserIDReserved = "reserved"
+	UserIDTaken    = "taken"
+	UserIDHeld     = "held"
+	UserIDCooldown = "cooldown"
+)
+
+// userIDPattern only allows ASCII after NFKC normalization, which also rules out
+// look-alike letters from other scripts
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{2,29}$`)
+
+// reservedUserIDs can't be registered because they name the service, its staff
+// or its pages. They are compared in lowercase with separators removed.
+var reservedUserIDs = map[string]bool{
+	"about": true, "abuse": true, "account": true, "accounts": true, "admin": true,
+	"administrator": true, "anonymous": true, "api": true, "auth": true, "billing": true,
+	"contact": true, "help": true, "hostmaster": true, "info": true, "login": true,
+	"logout": true, "me": true, "mod": true, "moderator": true, "noreply": true,
+	"null": true, "official": true, "postmaster": true, "privacy": true, "profile": true,
+	"register": true, "root": true, "security": true, "session": true, "sessions": true,
+	"settings": true, "shisha": true, "shishalog": true, "signin": true, "signup": true,
+	"staff": true, "support": true, "system": true, "terms": true, "undefined": true,
+	"user": true, "users": true, "webmaster": true, "www": true,
+}
+
+// UserIDError explains why a user ID can't be used
+type UserIDError struct {
+	Reason  string
+	Message string
+	RetryAt time.Time // when the user can change their user ID again, for UserIDCooldown
+}
+
+func (e *UserIDError) Error() string {
+	return e.Message
+}
+
+// UserIDService validates user IDs and changes them. A user ID that was changed
+// away from stays held for its previous owner for a while, so nobody can take
+// it over and logins with it keep working.
+type UserIDService struct {
+	userRepo   *repository.UserRepository
+	cooldown   time.Duration
+	holdPeriod time.Duration
+}
+
+func NewUserIDService(cfg *config.Config, userRepo *repository.UserRepository) *UserIDService {
+	return &UserIDService{
+		userRepo:   userRepo,
+		cooldown:   ParseDurationSetting(cfg.UserIDChangeCooldown, 30*24*time.Hour),
+		holdPeriod: ParseDurationSetting(cfg.UserIDHoldPeriod, 90*24*time.Hour),
+	}
+}
+
+// NormalizeUserID folds full-width and other compatibility characters, so
+// "ｊｏｈｎ" is stored as "john"
+func NormalizeUserID(userID string) string {
+	return strings.TrimSpace(norm.NFKC.String(userID))
+}
+
+// ValidateUserID checks the format of a user ID and that it isn't reserved. It
+// returns the normalized user ID.
+func ValidateUserID(userID string) (string, error) {
+	userID = NormalizeUserID(userID)
+	if !userIDPattern.MatchString(userID) {
+		return userID, &UserIDError{
+			Reason:  UserIDInvalid,
+			Message: "User ID must be 3 to 30 letters, digits, '_', '.' or '-', starting with a letter or digit",
+		}
+	}
+
+	key := strings.NewReplacer("_", "", ".", "", "-", "").Replace(strings.ToLower(userID))
+	if reservedUserIDs[key] {
+		return userID, &UserIDError{Reason: UserIDReserved, Message: "User ID is reserved"}
+	}
+
+	return userID, nil
+}
+
+// Check validates a user ID and makes sure nobody else uses or holds it. owner
+// is the user who wants it, or nil for a new account. It returns the normalized
+// user ID.
+func (s *UserIDService) Check(userID string, owner *uuid.UUID) (string, error) {
+	userID, err := ValidateUserID(userID)
+	if err != nil {
+		return userID, err
+	}
+
+	user, err := s.userRepo.GetByUserID(userID)
+	if err == nil && (owner == nil || user.ID != *owner) {
+		return userID, &UserIDError{Reason: UserIDTaken, Message: "User ID already exists"}
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return userID, err
+	}
+
+	user, err = s.userRepo.GetByPreviousUserID(userID)
+	if err == nil && (owner == nil || user.ID != *owner) {
+		return userID, &UserIDError{Reason: UserIDHeld, Message: "User ID was recently in use and isn't available yet"}
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return userID, err
+	}
+
+	return userID, nil
+}
+
+// Lookup finds the user for a user ID entered at login, following a recent
+// change of user ID
+func (s *UserIDService) Lookup(userID string) (*models.User, error) {
+	user, err := s.userRepo.GetByUserID(userID)
+	if err == sql.ErrNoRows {
+		return s.userRepo.GetByPreviousUserID(userID)
+	}
+	return user, err
+}
+
+// Change gives the user a new user ID, at most once per cooldown period. The old
+// one is held for them for the hold period.
+func (s *UserIDService) Change(userID uuid.UUID, newUserID string) (*models.User, error) {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	newUserID, err = s.Check(newUserID, &userID)
+	if err != nil {
+		return nil, err
+	}
+	if newUserID == user.UserID {
+		return user, nil
+	}
+
+	if user.UserIDChangedAt != nil {
+		if retryAt := user.UserIDChangedAt.Add(s.cooldown); retryAt.After(time.Now()) {
+			return nil, cooldownError(retryAt)
+		}
+	}
+
+	now := time.Now()
+	user, err = s.userRepo.ChangeUserID(userID, newUserID, now.Add(-s.cooldown), now.Add(s.holdPeriod))
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrDuplicate):
+			return nil, &UserIDError{Reason: UserIDTaken, Message: "User ID already exists"}
+		case err == sql.ErrNoRows:
+			// Changed by a concurrent request since we read the user
+			return nil, cooldownError(now.Add(s.cooldown))
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func cooldownError(retryAt time.Time) *UserIDError {
+	return &UserIDError{
+		Reason:  UserIDCooldown,
+		Message: fmt.Sprintf("User ID can't be changed again until %s", retryAt.UTC().Format(time.RFC3339)),
+		RetryAt: retryAt,
+	}
+}
@@ -54,7 +54,7 @@ export TF_VAR_project_name="${PROJECT_NAME:-shisha-log}"
 export TF_VAR_aws_region="${AWS_REGION:-ap-northeast-1}"
 export TF_VAR_availability_zone="${AVAILABILITY_ZONE:-ap-northeast-1a}"
 export TF_VAR_container_registry="${CONTAINER_REGISTRY:-public.ecr.aws}"
-export TF_VAR_token_duration="${TOKEN_DURATION:-24h}"
+export TF_VAR_token_duration="${TOKEN_DURATION:-15m}"
 
 echo "✓ Environment-specific defaults set for ${ENV}"
 
@@ -0,0 +1,42 @@
+-- Create passkey credentials table (WebAuthn)
+CREATE TABLE IF NOT EXISTS public.passkey_credentials (
+    id TEXT PRIMARY KEY, -- base64url encoded credential ID from WebAuthn
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    public_key BYTEA NOT NULL, -- public key in COSE format
+    attestation_type TEXT,
+    counter BIGINT NOT NULL DEFAULT 0, -- signature counter for replay protection
+    aaguid BYTEA, -- authenticator attestation GUID
+    transports TEXT[], -- supported transports (usb, nfc, ble, internal, hybrid)
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    backup_state BOOLEAN NOT NULL DEFAULT FALSE,
+    device_name TEXT, -- optional friendly name for the device
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ
+);
+
+-- Create authentication challenges table (for WebAuthn ceremonies)
+CREATE TABLE IF NOT EXISTS public.auth_challenges (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    challenge TEXT NOT NULL, -- base64url encoded challenge
+    user_id UUID REFERENCES public.users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL CHECK (type IN ('registration', 'authentication')),
+    session_data JSONB NOT NULL, -- webauthn.SessionData for the ceremony
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_passkey_credentials_user_id ON public.passkey_credentials(user_id);
+CREATE INDEX idx_auth_challenges_expires_at ON public.auth_challenges(expires_at);
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.passkey_credentials ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.auth_challenges ENABLE ROW LEVEL SECURITY;
+
+-- Clean up expired challenges periodically
+CREATE OR REPLACE FUNCTION public.cleanup_expired_challenges()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.auth_challenges WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
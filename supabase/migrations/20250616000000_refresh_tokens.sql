@@ -0,0 +1,30 @@
+-- Create refresh tokens table
+-- Only a SHA-256 digest of each opaque token is stored. Every login starts a new
+-- family; rotating a token marks it used and issues the next one in the same family.
+CREATE TABLE IF NOT EXISTS public.refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    family_id UUID NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_refresh_tokens_user_id ON public.refresh_tokens(user_id);
+CREATE INDEX idx_refresh_tokens_family_id ON public.refresh_tokens(family_id);
+CREATE INDEX idx_refresh_tokens_expires_at ON public.refresh_tokens(expires_at);
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.refresh_tokens ENABLE ROW LEVEL SECURITY;
+
+-- Clean up expired tokens periodically
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,32 @@
+-- Create revoked access tokens table (keyed by the JWT jti claim)
+CREATE TABLE IF NOT EXISTS public.revoked_tokens (
+    jti TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL, -- when the token would have expired anyway
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create per-user revocations used by logout-all
+CREATE TABLE IF NOT EXISTS public.user_token_revocations (
+    user_id UUID PRIMARY KEY REFERENCES public.users(id) ON DELETE CASCADE,
+    issued_before TIMESTAMPTZ NOT NULL, -- tokens issued before this time are rejected
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Create indexes
+CREATE INDEX idx_revoked_tokens_expires_at ON public.revoked_tokens(expires_at);
+CREATE INDEX idx_user_token_revocations_expires_at ON public.user_token_revocations(expires_at);
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.revoked_tokens ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.user_token_revocations ENABLE ROW LEVEL SECURITY;
+
+-- Clean up expired tokens periodically
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+    DELETE FROM public.revoked_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_token_revocations WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
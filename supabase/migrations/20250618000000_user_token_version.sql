@@ -0,0 +1,4 @@
+-- Add token version to users
+-- Access tokens embed the version they were issued under and are rejected once it
+-- changes, which happens whenever the password is changed or reset.
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
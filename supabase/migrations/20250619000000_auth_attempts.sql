@@ -0,0 +1,26 @@
+-- Create auth attempts table (brute-force protection and rate limiting counters)
+CREATE TABLE IF NOT EXISTS public.auth_attempts (
+    key TEXT PRIMARY KEY, -- e.g. login:<user_id>, ip:auth:<address>
+    count INTEGER NOT NULL DEFAULT 0,
+    window_start TIMESTAMPTZ NOT NULL,
+    last_attempt_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL -- end of the current window
+);
+
+-- Create indexes
+CREATE INDEX idx_auth_attempts_expires_at ON public.auth_attempts(expires_at);
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.auth_attempts ENABLE ROW LEVEL SECURITY;
+
+-- Clean up expired tokens periodically
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+    DELETE FROM public.revoked_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_token_revocations WHERE expires_at < NOW();
+    DELETE FROM public.auth_attempts WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,29 @@
+-- Create TOTP two-factor settings table
+CREATE TABLE IF NOT EXISTS public.user_mfa (
+    user_id UUID PRIMARY KEY REFERENCES public.users(id) ON DELETE CASCADE,
+    totp_secret TEXT NOT NULL, -- AES-GCM encrypted base32 secret
+    enabled_at TIMESTAMPTZ, -- NULL until the first code has been confirmed
+    last_used_step BIGINT NOT NULL DEFAULT 0, -- last accepted time step, prevents code replay
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create one-time recovery codes table
+CREATE TABLE IF NOT EXISTS public.mfa_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_mfa_recovery_codes_user_id ON public.mfa_recovery_codes(user_id);
+
+-- Create trigger for user_mfa table
+CREATE TRIGGER update_user_mfa_updated_at BEFORE UPDATE ON public.user_mfa
+    FOR EACH ROW EXECUTE FUNCTION public.update_updated_at_column();
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.user_mfa ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.mfa_recovery_codes ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,37 @@
+-- Add a verified contact address used for account recovery.
+-- An address is only written here once it has been verified.
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS email TEXT;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON public.users(LOWER(email));
+
+-- Create email verification tokens table
+CREATE TABLE IF NOT EXISTS public.email_verification_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL, -- address being verified
+    token_hash TEXT NOT NULL UNIQUE, -- SHA-256 of the token sent to the address
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_email_verification_tokens_user_id ON public.email_verification_tokens(user_id);
+CREATE INDEX idx_email_verification_tokens_expires_at ON public.email_verification_tokens(expires_at);
+
+-- Clean up expired verification tokens along with the others
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+    DELETE FROM public.revoked_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_token_revocations WHERE expires_at < NOW();
+    DELETE FROM public.auth_attempts WHERE expires_at < NOW();
+    DELETE FROM public.email_verification_tokens WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.email_verification_tokens ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,17 @@
+-- Store only a SHA-256 digest of password reset tokens
+ALTER TABLE public.password_reset_tokens ADD COLUMN IF NOT EXISTS token_hash TEXT;
+
+-- Hash outstanding tokens so links that were already sent keep working
+UPDATE public.password_reset_tokens
+SET token_hash = encode(sha256(convert_to(token, 'UTF8')), 'hex')
+WHERE token_hash IS NULL;
+
+ALTER TABLE public.password_reset_tokens ALTER COLUMN token_hash SET NOT NULL;
+
+-- Drop the plaintext column along with its index
+DROP INDEX IF EXISTS public.idx_password_reset_tokens_token;
+ALTER TABLE public.password_reset_tokens DROP COLUMN IF EXISTS token;
+
+-- Create indexes
+CREATE UNIQUE INDEX IF NOT EXISTS idx_password_reset_tokens_token_hash ON public.password_reset_tokens(token_hash);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON public.password_reset_tokens(user_id);
@@ -0,0 +1,8 @@
+-- Track accounts waiting to be purged. The row is deleted last, so a purge that
+-- fails halfway is picked up again by the scheduled job.
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMPTZ;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS deletion_scheduled_for TIMESTAMPTZ;
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_for ON public.users(deletion_scheduled_for)
+    WHERE deletion_scheduled_for IS NOT NULL;
@@ -0,0 +1,33 @@
+-- Create signed-in devices table. One row per refresh token family; access
+-- tokens carry the id as their sid claim.
+CREATE TABLE IF NOT EXISTS public.auth_devices (
+    id UUID PRIMARY KEY, -- refresh_tokens.family_id
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    device_label TEXT NOT NULL, -- e.g. "Chrome on macOS", derived from the User-Agent
+    user_agent TEXT,
+    ip_address TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL -- when the latest refresh token of the family expires
+);
+
+-- Create indexes
+CREATE INDEX idx_auth_devices_user_id ON public.auth_devices(user_id);
+CREATE INDEX idx_auth_devices_expires_at ON public.auth_devices(expires_at);
+
+-- Forget devices whose refresh tokens have expired
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+    DELETE FROM public.revoked_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_token_revocations WHERE expires_at < NOW();
+    DELETE FROM public.auth_attempts WHERE expires_at < NOW();
+    DELETE FROM public.email_verification_tokens WHERE expires_at < NOW();
+    DELETE FROM public.auth_devices WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.auth_devices ENABLE ROW LEVEL SECURITY;
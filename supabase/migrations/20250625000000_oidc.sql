@@ -0,0 +1,45 @@
+-- Create pending OpenID Connect authorization requests table
+CREATE TABLE IF NOT EXISTS public.oidc_states (
+    id TEXT PRIMARY KEY, -- the state parameter sent to the provider
+    provider TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL, -- PKCE verifier, only its S256 challenge is sent to the provider
+    user_id UUID REFERENCES public.users(id) ON DELETE CASCADE, -- set when linking to an existing account
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create linked provider accounts table
+CREATE TABLE IF NOT EXISTS public.user_identities (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL, -- the provider's sub claim
+    email TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_login_at TIMESTAMPTZ,
+    UNIQUE (provider, subject)
+);
+
+-- Create indexes
+CREATE INDEX idx_oidc_states_expires_at ON public.oidc_states(expires_at);
+CREATE INDEX idx_user_identities_user_id ON public.user_identities(user_id);
+
+-- Clean up abandoned authorization requests along with the other tokens
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+    DELETE FROM public.revoked_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_token_revocations WHERE expires_at < NOW();
+    DELETE FROM public.auth_attempts WHERE expires_at < NOW();
+    DELETE FROM public.email_verification_tokens WHERE expires_at < NOW();
+    DELETE FROM public.auth_devices WHERE expires_at < NOW();
+    DELETE FROM public.oidc_states WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.oidc_states ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.user_identities ENABLE ROW LEVEL SECURITY;
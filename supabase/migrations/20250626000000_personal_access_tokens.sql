@@ -0,0 +1,36 @@
+-- Create personal access tokens table. Tokens are shown once when created; only
+-- their SHA-256 hash is stored.
+CREATE TABLE IF NOT EXISTS public.personal_access_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    token_prefix TEXT NOT NULL, -- first characters of the token so users can tell them apart
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    last_used_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ, -- NULL for tokens that never expire
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_personal_access_tokens_user_id ON public.personal_access_tokens(user_id);
+CREATE INDEX idx_personal_access_tokens_expires_at ON public.personal_access_tokens(expires_at);
+
+-- Remove personal access tokens once they expire
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+    DELETE FROM public.revoked_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_token_revocations WHERE expires_at < NOW();
+    DELETE FROM public.auth_attempts WHERE expires_at < NOW();
+    DELETE FROM public.email_verification_tokens WHERE expires_at < NOW();
+    DELETE FROM public.auth_devices WHERE expires_at < NOW();
+    DELETE FROM public.oidc_states WHERE expires_at < NOW();
+    DELETE FROM public.personal_access_tokens WHERE expires_at < NOW();
+END;
+$$ LANGUAGE plpgsql;
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.personal_access_tokens ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,41 @@
+-- Create security audit log. Rows are only ever inserted and outlive the
+-- account they belong to: purging the account only clears user_id.
+CREATE TABLE IF NOT EXISTS public.audit_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES public.users(id) ON DELETE SET NULL, -- account the event is about, NULL if unknown or purged
+    actor_id UUID, -- user who performed the action when it isn't the account owner
+    account TEXT, -- user ID as entered, kept for logins to accounts that don't exist
+    event_type TEXT NOT NULL, -- e.g. login, password_change
+    outcome TEXT NOT NULL CHECK (outcome IN ('success', 'failure')),
+    reason TEXT, -- why the action failed or what it required, e.g. invalid_password
+    ip_address TEXT,
+    user_agent TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_audit_events_user_id_created_at ON public.audit_events(user_id, created_at DESC);
+CREATE INDEX idx_audit_events_event_type_created_at ON public.audit_events(event_type, created_at DESC);
+CREATE INDEX idx_audit_events_ip_address ON public.audit_events(ip_address);
+CREATE INDEX idx_audit_events_created_at ON public.audit_events(created_at DESC);
+
+-- Reject changes to and deletion of recorded events. The only update allowed
+-- is clearing user_id when the account is purged.
+CREATE OR REPLACE FUNCTION public.prevent_audit_event_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.user_id IS NOT NULL AND NEW.user_id IS NULL
+        AND ROW(NEW.id, NEW.actor_id, NEW.account, NEW.event_type, NEW.outcome, NEW.reason, NEW.ip_address, NEW.user_agent, NEW.created_at)
+            IS NOT DISTINCT FROM
+            ROW(OLD.id, OLD.actor_id, OLD.account, OLD.event_type, OLD.outcome, OLD.reason, OLD.ip_address, OLD.user_agent, OLD.created_at) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER prevent_audit_events_change BEFORE UPDATE OR DELETE ON public.audit_events
+    FOR EACH ROW EXECUTE FUNCTION public.prevent_audit_event_change();
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.audit_events ENABLE ROW LEVEL SECURITY;
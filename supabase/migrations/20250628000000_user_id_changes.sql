@@ -0,0 +1,59 @@
+-- User IDs are unique regardless of case and width, so "JohnDoe" and "ｊｏｈｎｄｏｅ" are the same
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS user_id_normalized TEXT GENERATED ALWAYS AS (lower(normalize(user_id, NFKC))) STORED,
+    ADD COLUMN IF NOT EXISTS user_id_changed_at TIMESTAMPTZ;
+
+-- Create user ID history table
+CREATE TABLE IF NOT EXISTS public.user_id_history (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    previous_user_id TEXT NOT NULL,
+    previous_user_id_normalized TEXT NOT NULL,
+    held_until TIMESTAMPTZ NOT NULL, -- nobody else can take the old user ID before this
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE UNIQUE INDEX idx_users_user_id_normalized ON public.users(user_id_normalized);
+CREATE INDEX idx_user_id_history_user_id ON public.user_id_history(user_id);
+CREATE INDEX idx_user_id_history_previous_user_id_normalized ON public.user_id_history(previous_user_id_normalized);
+CREATE INDEX idx_user_id_history_held_until ON public.user_id_history(held_until);
+
+-- Reject user IDs that are held for another account, whichever code path writes them
+CREATE OR REPLACE FUNCTION public.check_user_id_not_held()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM public.user_id_history
+        WHERE previous_user_id_normalized = lower(normalize(NEW.user_id, NFKC))
+            AND held_until > NOW()
+            AND user_id <> NEW.id
+    ) THEN
+        RAISE EXCEPTION 'user_id % is held', NEW.user_id USING ERRCODE = 'unique_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER check_users_user_id_not_held BEFORE INSERT OR UPDATE OF user_id ON public.users
+    FOR EACH ROW EXECUTE FUNCTION public.check_user_id_not_held();
+
+-- Release held user IDs once the hold period is over
+CREATE OR REPLACE FUNCTION public.cleanup_expired_tokens()
+RETURNS void AS $$
+BEGIN
+    DELETE FROM public.password_reset_tokens WHERE expires_at < NOW();
+    DELETE FROM public.refresh_tokens WHERE expires_at < NOW();
+    DELETE FROM public.revoked_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_token_revocations WHERE expires_at < NOW();
+    DELETE FROM public.auth_attempts WHERE expires_at < NOW();
+    DELETE FROM public.email_verification_tokens WHERE expires_at < NOW();
+    DELETE FROM public.auth_devices WHERE expires_at < NOW();
+    DELETE FROM public.oidc_states WHERE expires_at < NOW();
+    DELETE FROM public.personal_access_tokens WHERE expires_at < NOW();
+    DELETE FROM public.user_id_history WHERE held_until < NOW();
+END;
+$$ LANGUAGE plpgsql;
+
+-- RLS policies (if using Supabase Auth)
+ALTER TABLE public.user_id_history ENABLE ROW LEVEL SECURITY;
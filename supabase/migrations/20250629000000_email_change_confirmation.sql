@@ -0,0 +1,10 @@
+-- Changing a verified address needs a link opened at the new and at the current
+-- address. Both tokens of a change share request_id; the address is only set on
+-- the user once every token of the request has been used.
+ALTER TABLE public.email_verification_tokens
+    ADD COLUMN IF NOT EXISTS request_id UUID NOT NULL DEFAULT uuid_generate_v4(),
+    ADD COLUMN IF NOT EXISTS purpose TEXT NOT NULL DEFAULT 'verify' CHECK (purpose IN ('verify', 'approve_change')),
+    ADD COLUMN IF NOT EXISTS sent_at TIMESTAMPTZ NOT NULL DEFAULT NOW(); -- last time the link was sent, for resends
+
+-- Create indexes
+CREATE INDEX idx_email_verification_tokens_request_id ON public.email_verification_tokens(request_id);
@@ -0,0 +1,8 @@
+-- Add a role to every user. Grant a role with
+--   UPDATE public.users SET role = 'admin', token_version = token_version + 1 WHERE user_id = '...';
+-- bumping token_version so tokens issued with the old role stop working.
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'));
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_users_role ON public.users(role) WHERE role <> 'user';
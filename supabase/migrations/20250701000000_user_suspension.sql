@@ -0,0 +1,10 @@
+-- Let admins suspend accounts and require a new password
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ, -- suspended users can't log in or use any token
+    ADD COLUMN IF NOT EXISTS suspended_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS suspension_reason TEXT,
+    ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE; -- password logins are refused until reset
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_users_suspended_at ON public.users(suspended_at) WHERE suspended_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON public.users(created_at);
@@ -0,0 +1,19 @@
+-- Keep the flavors of a session in the order the user chose
+ALTER TABLE public.session_flavors
+    ADD COLUMN IF NOT EXISTS position INTEGER;
+
+-- Existing flavors keep the order they were added in
+UPDATE public.session_flavors f
+SET position = ordered.position
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY session_id ORDER BY created_at, id) - 1 AS position
+    FROM public.session_flavors
+) ordered
+WHERE f.id = ordered.id AND f.position IS NULL;
+
+ALTER TABLE public.session_flavors
+    ALTER COLUMN position SET NOT NULL;
+
+-- Checked at commit, so flavors can be moved by shifting positions in a transaction
+ALTER TABLE public.session_flavors
+    ADD CONSTRAINT session_flavors_session_id_position_key UNIQUE (session_id, position) DEFERRABLE INITIALLY DEFERRED;
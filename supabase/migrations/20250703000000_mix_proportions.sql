@@ -0,0 +1,7 @@
+-- Record how much of each flavor went into the bowl
+ALTER TABLE public.shisha_sessions
+    ADD COLUMN IF NOT EXISTS bowl_weight_grams NUMERIC(6, 2) CHECK (bowl_weight_grams > 0);
+
+ALTER TABLE public.session_flavors
+    ADD COLUMN IF NOT EXISTS percentage NUMERIC(5, 2) CHECK (percentage > 0 AND percentage <= 100), -- share of the mix
+    ADD COLUMN IF NOT EXISTS grams NUMERIC(6, 2) CHECK (grams > 0);
@@ -0,0 +1,11 @@
+-- Rate sessions from 1 to 5: an overall score and optional details
+ALTER TABLE public.shisha_sessions
+    ADD COLUMN IF NOT EXISTS rating SMALLINT CHECK (rating BETWEEN 1 AND 5),
+    ADD COLUMN IF NOT EXISTS taste_rating SMALLINT CHECK (taste_rating BETWEEN 1 AND 5),
+    ADD COLUMN IF NOT EXISTS smoke_volume_rating SMALLINT CHECK (smoke_volume_rating BETWEEN 1 AND 5), -- 5 is the most smoke
+    ADD COLUMN IF NOT EXISTS harshness_rating SMALLINT CHECK (harshness_rating BETWEEN 1 AND 5), -- 5 is the harshest
+    ADD COLUMN IF NOT EXISTS heat_stability_rating SMALLINT CHECK (heat_stability_rating BETWEEN 1 AND 5),
+    ADD COLUMN IF NOT EXISTS longevity_rating SMALLINT CHECK (longevity_rating BETWEEN 1 AND 5);
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_shisha_sessions_user_id_rating ON public.shisha_sessions(user_id, rating);
@@ -0,0 +1,11 @@
+-- Time live sessions from start to stop
+ALTER TABLE public.shisha_sessions
+    ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS ended_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS auto_stopped BOOLEAN NOT NULL DEFAULT FALSE, -- stopped by the server after SESSION_MAX_DURATION
+    ADD CONSTRAINT shisha_sessions_timing_check CHECK (ended_at IS NULL OR (started_at IS NOT NULL AND ended_at >= started_at));
+
+-- Create indexes
+-- A user can only have one session running at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_shisha_sessions_active_user_id ON public.shisha_sessions(user_id)
+    WHERE started_at IS NOT NULL AND ended_at IS NULL;